@@ -3,12 +3,87 @@ package connections
 import (
 	"context"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"gocloud.dev/pubsub/driver"
+	"time"
+)
+
+// MessageIDSource decides where the Nats-Msg-Id header of published messages is taken from.
+// Jetstream drops messages whose id was already seen within the duplicate window of the stream.
+// The LoggableID of a message can not carry the id, pubsub.Topic.Send rejects messages that set it.
+type MessageIDSource int
+
+const (
+	// MessageIDNone publishes messages without an id, so they are never deduplicated.
+	MessageIDNone MessageIDSource = iota
+	// MessageIDFromMetadata uses the value of the metadata entry named by TopicOptions.MessageIDMetadataKey.
+	MessageIDFromMetadata
+	// MessageIDFromContentHash uses a hash of the body and metadata, so identical messages are stored once.
+	MessageIDFromContentHash
 )
 
 // TopicOptions sets options for constructing a *pubsub.Topic backed by NATS.
 type TopicOptions struct {
 	Subject string
+
+	// SubjectTemplate routes every message to its own subject, filling placeholders such as
+	// orders.{region}.{type} with the metadata values of the message.
+	SubjectTemplate string
+	// SubjectFunc routes every message to the subject it returns, it can not be combined with SubjectTemplate.
+	SubjectFunc func(body []byte, metadata map[string]string) (string, error)
+
+	// Acknowledged waits for a subscriber to acknowledge every message published over plain nats,
+	// publishing it again whenever it is negatively acknowledged or no acknowledgement arrives in time.
+	// The subscriptions have to be opened with Acknowledged set as well.
+	Acknowledged bool
+	// AckTimeout is how long each attempt waits for an acknowledgement, defaults to 30s.
+	AckTimeout time.Duration
+	// MaxAckAttempts limits how many times a message is published, zero keeps trying until the context is done.
+	MaxAckAttempts int
+
+	// MaxBatchSize, MinBatchSize, MaxHandlers and MaxBatchByteSize configure how the topic batches messages
+	// before sending them, see batcher.Options. Zero keeps the gocloud defaults.
+	MaxBatchSize     int
+	MinBatchSize     int
+	MaxHandlers      int
+	MaxBatchByteSize int
+	// PublishConcurrency is how many messages of a batch are published at once, messages are no longer
+	// published in order when it is above one. Zero publishes one message at a time.
+	PublishConcurrency int
+
+	// FlushOnSend confirms that the server received every batch published over plain nats,
+	// by flushing the connection and checking it for errors before reporting success.
+	FlushOnSend bool
+	// FlushTimeout bounds the wait for the server to confirm a flush, defaults to 10s.
+	FlushTimeout time.Duration
+
+	// PublishRetry retries jetstream publishes failing with transient errors, such as during stream leader elections.
+	// It applies to messages published one at a time, MaxPendingPublishes batches use AsyncPublishRetries instead.
+	PublishRetry PublishRetryPolicy
+
+	// MaxPendingPublishes publishes batches to jetstream asynchronously, with at most this many messages
+	// awaiting their acknowledgement at once. Zero publishes one message at a time, waiting for each.
+	MaxPendingPublishes int
+	// AsyncPublishRetries is how many more times messages that failed an asynchronous publish are sent, in their
+	// original order. Messages without a Nats-Msg-Id are given one so that retries are not stored twice.
+	AsyncPublishRetries int
+
+	// MessageIDSource sets the Nats-Msg-Id of every message, so jetstream can drop messages published twice.
+	// Messages without a value for the chosen source are published without an id.
+	MessageIDSource MessageIDSource
+	// MessageIDMetadataKey names the metadata entry holding the message id when using MessageIDFromMetadata.
+	MessageIDMetadataKey string
+
+	// ScheduleStream holds back messages whose deliver-at metadata is set in this jetstream stream,
+	// until a Scheduler running against it delivers them to their subject. It is created when missing.
+	// Only jetstream connections can hold messages back, plain ones refuse topics setting it.
+	ScheduleStream string
+
+	// HeaderCodec encodes the metadata of messages into headers, query escaping keys and values when nil.
+	HeaderCodec HeaderCodec
+
+	// Outbox stores messages on disk while the server can not be reached, relaying them in order once it can.
+	Outbox *OutboxOptions
 }
 
 // SetupOptions sets options utilized especially when creating streams/queues
@@ -17,10 +92,40 @@ type SetupOptions struct {
 	StreamName        string
 	StreamDescription string
 
-	Subjects     []string
+	Subjects []string
+	// FilterSubjects limits the subjects delivered to the consumer, defaults to all Subjects when empty.
+	// On jetstream these map to the consumer filter, on plain nats each one becomes a subscription.
+	FilterSubjects []string
+
+	// ConsumerName names the consumer created on the stream, independently of the stream name.
+	// When a DurableQueue is also supplied both values must match.
+	ConsumerName string
+	// DurableQueue is the durable consumer (or queue group) name, leave it empty to get an ephemeral consumer.
 	DurableQueue string
+	// ConsumerInactiveThresholdMs is how long an ephemeral consumer may sit idle before the server removes it.
+	ConsumerInactiveThresholdMs int
+	// ConsumerAckWait is how long the server waits for an acknowledgement before redelivering, defaults to 30s.
+	ConsumerAckWait time.Duration
+	// ConsumerMaxDeliver limits how many times a message is delivered, zero leaves it unlimited.
+	ConsumerMaxDeliver int
+	// ConsumerBackOff sets the redelivery waits the server applies to messages that were not acknowledged in time.
+	// ConsumerMaxDeliver has to be larger than the number of waits given.
+	ConsumerBackOff []time.Duration
 }
 
+// AckMode decides how acknowledgements are sent to the server.
+type AckMode int
+
+const (
+	// AckSync waits for the server to confirm every acknowledgement, a batch is confirmed concurrently.
+	AckSync AckMode = iota
+	// AckFireAndForget sends acknowledgements without waiting for the server to confirm them.
+	AckFireAndForget
+	// AckAsync confirms acknowledgements in the background, failures are reported by the following call.
+	// A fixed number of acknowledgements are confirmed at once, further acks wait for their turn.
+	AckAsync
+)
+
 // SubscriptionOptions sets options for subscribing to NATS.
 // The appropriate *pubsub.Subscription is created as a result here.
 type SubscriptionOptions struct {
@@ -28,6 +133,49 @@ type SubscriptionOptions struct {
 	ConsumerMaxBatchSize      int
 	ConsumerMaxBatchBytesSize int
 	ConsumerMaxBatchTimeoutMs int
+	// ConsumerPendingMsgsLimit and ConsumerPendingBytesLimit set the slow consumer limits of plain nats subscriptions,
+	// messages beyond these limits are dropped by the client. Zero keeps the nats defaults, negative means unlimited.
+	ConsumerPendingMsgsLimit  int
+	ConsumerPendingBytesLimit int
+
+	// Acknowledged answers the reply subject of messages received over plain nats when they are acked or nacked,
+	// giving at least once delivery together with a topic that is Acknowledged as well.
+	Acknowledged bool
+
+	// AckMode decides how acknowledgements are confirmed, by default they are confirmed synchronously.
+	AckMode AckMode
+	// LeaseRenewalFraction opts in to extending the ack deadline of messages still being handled,
+	// progress is reported each time this fraction of the consumer AckWait elapses, e.g. 0.5.
+	// Values outside of 0 and 1 are rejected with ErrInvalidLeaseFraction.
+	LeaseRenewalFraction float64
+	// LeaseMaxDuration stops the ack deadline of a message being extended once it was held this long.
+	LeaseMaxDuration time.Duration
+
+	// HeaderCodec decodes the headers of received messages into metadata, query unescaping them when nil.
+	// It has to match the codec the messages were published with.
+	HeaderCodec HeaderCodec
+
+	// TerminateUndecodable terminates messages that fail to decode, e.g. because of badly escaped headers,
+	// instead of failing the whole batch they were received in.
+	TerminateUndecodable bool
+
+	// DeadLetterSubject receives a copy of every message that reached the consumer MaxDeliver, jetstream only.
+	// A stream storing the subject is created when none exists yet, it has to be another stream than the one consumed.
+	DeadLetterSubject string
+
+	// ErrorHandler is given the failures of work done in the background for the subscription, such as dead lettering,
+	// which can not be returned to a caller. They are dropped when it is nil.
+	ErrorHandler func(error)
+
+	// RedeliveryPolicy delays the redelivery of negatively acknowledged messages, by default they are redelivered at once.
+	RedeliveryPolicy RedeliveryPolicy
+
+	// DeliverPolicy decides where in the stream a newly created consumer starts reading from.
+	DeliverPolicy jetstream.DeliverPolicy
+	// StartSequence replays the stream starting at this stream sequence.
+	StartSequence uint64
+	// StartTime replays the stream starting at the first message stored at or after this time.
+	StartTime *time.Time
 
 	SetupOpts *SetupOptions
 }
@@ -45,12 +193,39 @@ type Queue interface {
 	Unsubscribe() error
 	Ack(ctx context.Context, ids []driver.AckID) error
 	Nack(ctx context.Context, ids []driver.AckID) error
+	// IsDurable reports whether messages are redelivered until acknowledged, only such queues can be nacked.
 	IsDurable() bool
 }
 
+// DroppedCounter is implemented by queues that can lose messages when the consumer falls behind.
+type DroppedCounter interface {
+	// Dropped returns the number of messages dropped so far because of slow consumption.
+	Dropped() (int, error)
+}
+
+// SkippedCounter is implemented by queues that pass over acknowledgement ids they can not handle.
+type SkippedCounter interface {
+	// Skipped returns the number of acknowledgement ids of an unexpected type seen so far.
+	Skipped() uint64
+}
+
+// Terminator is exposed through the As function of received messages that can be terminated.
+type Terminator interface {
+	// Terminate stops any further redelivery of the message, reason is recorded in the log.
+	Terminate(reason string) error
+}
+
+// TerminatedCounter is implemented by queues that can terminate messages.
+type TerminatedCounter interface {
+	// Terminated returns the number of messages terminated so far.
+	Terminated() uint64
+}
+
 type Topic interface {
 	Subject() string
-	PublishMessage(ctx context.Context, msg *nats.Msg) (string, error)
+	// PublishMessage sends msg, returning the acknowledgement of the stream that stored it.
+	// There is no acknowledgement for messages published over plain nats, so nil is returned.
+	PublishMessage(ctx context.Context, msg *nats.Msg) (*jetstream.PubAck, error)
 }
 
 type Connection interface {
@@ -58,3 +233,10 @@ type Connection interface {
 	CreateSubscription(ctx context.Context, opts *SubscriptionOptions) (Queue, error)
 	CreateTopic(ctx context.Context, opts *TopicOptions) (Topic, error)
 }
+
+// ConsumerResetter is implemented by connections whose consumers keep their position on the server.
+type ConsumerResetter interface {
+	// ResetConsumer recreates the durable consumer described by opts so that it
+	// starts delivering again from the position set in opts.
+	ResetConsumer(ctx context.Context, opts *SubscriptionOptions) error
+}
@@ -0,0 +1,104 @@
+package connections
+
+import (
+	"context"
+	"github.com/nats-io/nats.go/jetstream"
+	"sync"
+)
+
+// asyncAckWorkers is how many acknowledgements an AckAsync subscription confirms at once,
+// further acks wait for a free worker so a fast handler can not pile up goroutines.
+const asyncAckWorkers = 16
+
+// asyncAcker confirms acknowledgements with a fixed set of workers living as long as the subscription.
+// When it stops, acknowledgements queued or still awaiting confirmation are sent without waiting for the server.
+type asyncAcker struct {
+	msgs   chan jetstream.Msg
+	report func(error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	// mutex keeps messages from being queued while the queue is emptied on stop.
+	mutex   sync.RWMutex
+	stopped bool
+}
+
+// newAsyncAcker starts the workers, handing the outcome of every confirmation to report.
+func newAsyncAcker(report func(error)) *asyncAcker {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &asyncAcker{
+		msgs:   make(chan jetstream.Msg, asyncAckWorkers),
+		report: report,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	a.wg.Add(asyncAckWorkers)
+	for i := 0; i < asyncAckWorkers; i++ {
+		go a.run()
+	}
+	return a
+}
+
+func (a *asyncAcker) run() {
+	defer a.wg.Done()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case msg := <-a.msgs:
+			err := msg.DoubleAck(a.ctx)
+			if a.ctx.Err() != nil {
+				// Stopping abandoned the confirmation, the acknowledgement may not have been sent yet.
+				_ = msg.Ack()
+				return
+			}
+			a.report(ackError(err))
+		}
+	}
+}
+
+// ack queues msg for confirmation, waiting for room while ctx allows.
+// Once the acker stopped messages are acknowledged without waiting for the server.
+func (a *asyncAcker) ack(ctx context.Context, msg jetstream.Msg) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.stopped {
+		return ackError(msg.Ack())
+	}
+
+	select {
+	case a.msgs <- msg:
+		return nil
+	case <-a.ctx.Done():
+		return ackError(msg.Ack())
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop ends the workers and sends the acknowledgements still queued.
+func (a *asyncAcker) stop() {
+	a.once.Do(func() {
+		a.cancel()
+		a.wg.Wait()
+
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.stopped = true
+
+		for {
+			select {
+			case msg := <-a.msgs:
+				_ = msg.Ack()
+			default:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package connections
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers added to dead lettered messages, next to the headers of the original message.
+const (
+	HeaderDeadLetterStream     = "Dlq-Stream"
+	HeaderDeadLetterSequence   = "Dlq-Sequence"
+	HeaderDeadLetterSubject    = "Dlq-Subject"
+	HeaderDeadLetterDeliveries = "Dlq-Deliveries"
+	HeaderDeadLetterLastError  = "Dlq-Last-Error"
+)
+
+// maxDeliveriesAdvisoryFmt is the subject the server announces messages on once they reach MaxDeliver.
+const maxDeliveriesAdvisoryFmt = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s"
+
+// deadLetterConsumerName is the durable consumer reading the advisories, shared by all subscriptions on a consumer.
+const deadLetterConsumerName = "dead_letter_router"
+
+// defaultDeadLetterError is recorded on dead lettered messages for which no handling error is known.
+const defaultDeadLetterError = "maximum deliveries reached"
+
+// deadLetterRetryPolicy spaces out the retries of advisories whose message could not be read or dead lettered.
+var deadLetterRetryPolicy = ExponentialRedeliveryPolicy{Initial: time.Second, Max: time.Minute}
+
+// ErrDeadLetterSubjectInSourceStream is returned when the dead letter subject is stored by the stream messages are
+// dead lettered from, which would deliver them to the same consumers again.
+var ErrDeadLetterSubjectInSourceStream = errors.New("natspubsub: dead letter subject is stored by the source stream")
+
+// Reasons recorded on dead lettered messages that ran out of deliveries without a decoding error.
+var (
+	errDeadLetterNacked  = errors.New("natspubsub: message was negatively acknowledged")
+	errDeadLetterAckWait = errors.New("natspubsub: message was not acknowledged within the ack wait")
+)
+
+// maxDeliveriesAdvisory is the part of the server advisory needed to find the message that ran out of deliveries.
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// deadLetterRouter republishes messages that reached the MaxDeliver of a consumer to a dead letter subject.
+// The server advisories are captured in a work queue stream so that none are lost while no subscription is running,
+// and each advisory is handled once even when several subscriptions share the consumer.
+type deadLetterRouter struct {
+	jetStream jetstream.JetStream
+	source    jetstream.Stream
+	subject   string
+
+	advisoryStream string
+	// ephemeral routers remove their advisory stream once stopped, as the consumer they watch goes away too.
+	ephemeral bool
+	consuming jetstream.ConsumeContext
+	// errorHandler is given the advisories that could not be handled, it may be nil.
+	errorHandler func(error)
+
+	// lastErrors keeps the reason messages could not be handled, keyed by stream sequence. A message may be acked by
+	// another subscription, so reasons are dropped once kept for errorRetention past the redelivery they wait for.
+	errorsMutex    sync.Mutex
+	lastErrors     map[uint64]deadLetterError
+	errorRetention time.Duration
+	nextPrune      time.Time
+}
+
+// deadLetterError is the reason a message could not be handled, kept until expires.
+type deadLetterError struct {
+	reason  string
+	expires time.Time
+}
+
+func newDeadLetterRouter(ctx context.Context, js jetstream.JetStream, source jetstream.Stream,
+	consumer *jetstream.ConsumerInfo, subject string, ephemeral bool, errorHandler func(error)) (*deadLetterRouter, error) {
+
+	consumerName := consumer.Name
+
+	err := ensureDeadLetterStream(ctx, js, source.CachedInfo().Config.Name, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &deadLetterRouter{
+		jetStream:      js,
+		source:         source,
+		subject:        subject,
+		advisoryStream: fmt.Sprintf("%s_%s_advisories", source.CachedInfo().Config.Name, consumerName),
+		ephemeral:      ephemeral,
+		errorHandler:   errorHandler,
+		lastErrors:     map[uint64]deadLetterError{},
+		errorRetention: deadLetterErrorRetention(consumer.Config),
+	}
+
+	advisories, err := js.Stream(ctx, dr.advisoryStream)
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil, err
+	}
+
+	if advisories == nil {
+		advisories, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      dr.advisoryStream,
+			Subjects:  []string{fmt.Sprintf(maxDeliveriesAdvisoryFmt, source.CachedInfo().Config.Name, consumerName)},
+			Retention: jetstream.WorkQueuePolicy,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	advisoryConsumer, err := advisories.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   deadLetterConsumerName,
+		AckPolicy: jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dr.consuming, err = advisoryConsumer.Consume(dr.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	return dr, nil
+}
+
+// ensureDeadLetterStream creates a stream storing the dead letter subject unless one already does.
+// The source stream itself can not store it, as dead lettered messages would be delivered to its consumers again.
+func ensureDeadLetterStream(ctx context.Context, js jetstream.JetStream, sourceStream string, subject string) error {
+	stream, err := js.StreamNameBySubject(ctx, subject)
+	if err == nil && stream == sourceStream {
+		return fmt.Errorf("%w : %s stores %s", ErrDeadLetterSubjectInSourceStream, sourceStream, subject)
+	}
+	if err == nil || !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:     fmt.Sprintf("%s_dlq", sourceStream),
+		Subjects: []string{subject},
+	})
+	return err
+}
+
+// deadLetterErrorRetention is how long the reason of a failed delivery is kept, twice the longest wait
+// for the acknowledgement of a delivery.
+func deadLetterErrorRetention(cfg jetstream.ConsumerConfig) time.Duration {
+	wait := cfg.AckWait
+	if wait <= 0 {
+		wait = defaultAckWait
+	}
+	for _, backoff := range cfg.BackOff {
+		if backoff > wait {
+			wait = backoff
+		}
+	}
+	return 2 * wait
+}
+
+// recordError remembers why the message at sequence could not be handled, to be reported once it is dead lettered.
+// The message is redelivered after delay, the reason is kept for the retention of the router past that.
+func (dr *deadLetterRouter) recordError(sequence uint64, err error, delay time.Duration) {
+	dr.errorsMutex.Lock()
+	defer dr.errorsMutex.Unlock()
+
+	now := time.Now()
+	if now.After(dr.nextPrune) {
+		for seq, lastError := range dr.lastErrors {
+			if now.After(lastError.expires) {
+				delete(dr.lastErrors, seq)
+			}
+		}
+		dr.nextPrune = now.Add(dr.errorRetention)
+	}
+
+	dr.lastErrors[sequence] = deadLetterError{reason: err.Error(), expires: now.Add(delay).Add(dr.errorRetention)}
+}
+
+// forgetError drops the error recorded for the message at sequence, as it was handled after all.
+func (dr *deadLetterRouter) forgetError(sequence uint64) {
+	dr.errorsMutex.Lock()
+	defer dr.errorsMutex.Unlock()
+
+	delete(dr.lastErrors, sequence)
+}
+
+func (dr *deadLetterRouter) takeError(sequence uint64) string {
+	dr.errorsMutex.Lock()
+	defer dr.errorsMutex.Unlock()
+
+	lastError, ok := dr.lastErrors[sequence]
+	if !ok {
+		return defaultDeadLetterError
+	}
+	delete(dr.lastErrors, sequence)
+	return lastError.reason
+}
+
+// handle republishes the message an advisory points at, advisories are retried until the message is dead lettered
+// with waits growing as given by deadLetterRetryPolicy.
+func (dr *deadLetterRouter) handle(advisoryMsg jetstream.Msg) {
+	var advisory maxDeliveriesAdvisory
+	err := json.Unmarshal(advisoryMsg.Data(), &advisory)
+	if err != nil {
+		dr.reportError(fmt.Errorf("natspubsub: dropping unreadable max deliveries advisory : %w", err))
+		_ = advisoryMsg.Term()
+		return
+	}
+
+	ctx := context.Background()
+
+	original, err := dr.source.GetMsg(ctx, advisory.StreamSeq)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			dr.reportError(fmt.Errorf("natspubsub: message [%s:%d] to dead letter is no longer stored : %w",
+				advisory.Stream, advisory.StreamSeq, err))
+			_ = advisoryMsg.Ack()
+			return
+		}
+		dr.reportError(fmt.Errorf("natspubsub: message [%s:%d] to dead letter could not be read : %w",
+			advisory.Stream, advisory.StreamSeq, err))
+		_ = retryAdvisory(advisoryMsg)
+		return
+	}
+
+	msg := nats.NewMsg(dr.subject)
+	msg.Data = original.Data
+	for k, v := range original.Header {
+		msg.Header[k] = v
+	}
+	msg.Header.Set(HeaderDeadLetterStream, advisory.Stream)
+	msg.Header.Set(HeaderDeadLetterSequence, strconv.FormatUint(advisory.StreamSeq, 10))
+	msg.Header.Set(HeaderDeadLetterSubject, sanitizeHeaderValue(original.Subject))
+	msg.Header.Set(HeaderDeadLetterDeliveries, strconv.FormatUint(advisory.Deliveries, 10))
+	msg.Header.Set(HeaderDeadLetterLastError, sanitizeHeaderValue(dr.takeError(advisory.StreamSeq)))
+
+	_, err = dr.jetStream.PublishMsg(ctx, msg)
+	if err != nil {
+		dr.reportError(fmt.Errorf("natspubsub: message [%s:%d] could not be dead lettered : %w",
+			advisory.Stream, advisory.StreamSeq, err))
+		_ = retryAdvisory(advisoryMsg)
+		return
+	}
+
+	_ = advisoryMsg.Ack()
+}
+
+// retryAdvisory hands the advisory back to be handled again after the wait of deadLetterRetryPolicy.
+func retryAdvisory(advisoryMsg jetstream.Msg) error {
+	var numDelivered uint64
+	if metadata, err := advisoryMsg.Metadata(); err == nil {
+		numDelivered = metadata.NumDelivered
+	}
+	return advisoryMsg.NakWithDelay(deadLetterRetryPolicy.Delay(numDelivered))
+}
+
+func (dr *deadLetterRouter) reportError(err error) {
+	if dr.errorHandler != nil {
+		dr.errorHandler(err)
+	}
+}
+
+// sanitizeHeaderValue replaces the line breaks that would end a header early, the rest of the value is kept as it is.
+func sanitizeHeaderValue(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func (dr *deadLetterRouter) stop() error {
+	dr.consuming.Stop()
+
+	if !dr.ephemeral {
+		return nil
+	}
+
+	err := dr.jetStream.DeleteStream(context.Background(), dr.advisoryStream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return nil
+	}
+	return err
+}
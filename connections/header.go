@@ -0,0 +1,261 @@
+package connections
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidHeader is returned when a metadata key or value can not be carried in a nats header unchanged.
+var ErrInvalidHeader = errors.New("natspubsub: metadata can not be carried in a header")
+
+// HeaderCodec converts metadata keys and values to the text of nats headers and back.
+// Headers read by the server or set by this package, see IsRawHeader, are never passed through the codec.
+type HeaderCodec interface {
+	EncodeKey(key string) (string, error)
+	DecodeKey(key string) (string, error)
+	EncodeValue(value string) (string, error)
+	DecodeValue(value string) (string, error)
+}
+
+// QueryEscapeHeaderCodec query escapes keys and values, it is the default and can carry any text.
+// Clients in other languages see escaped headers and have to unescape them.
+type QueryEscapeHeaderCodec struct{}
+
+func (QueryEscapeHeaderCodec) EncodeKey(key string) (string, error) {
+	return url.QueryEscape(key), nil
+}
+
+func (QueryEscapeHeaderCodec) DecodeKey(key string) (string, error) {
+	return url.QueryUnescape(key)
+}
+
+func (QueryEscapeHeaderCodec) EncodeValue(value string) (string, error) {
+	return url.QueryEscape(value), nil
+}
+
+func (QueryEscapeHeaderCodec) DecodeValue(value string) (string, error) {
+	return url.QueryUnescape(value)
+}
+
+// RawHeaderCodec carries keys and values as they are, so headers read the same in every client.
+// Keys with separators, spaces or control characters and values with line breaks or surrounding spaces are rejected,
+// as they would not survive the header format.
+type RawHeaderCodec struct{}
+
+func (RawHeaderCodec) EncodeKey(key string) (string, error) {
+	return key, validateHeaderKey(key)
+}
+
+func (RawHeaderCodec) DecodeKey(key string) (string, error) {
+	return key, nil
+}
+
+func (RawHeaderCodec) EncodeValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") || strings.TrimSpace(value) != value {
+		return "", fmt.Errorf("%w : value %q has line breaks or surrounding spaces", ErrInvalidHeader, value)
+	}
+	return value, nil
+}
+
+func (RawHeaderCodec) DecodeValue(value string) (string, error) {
+	return value, nil
+}
+
+// Base64HeaderCodec carries keys as they are and values base64 encoded, for binary values.
+type Base64HeaderCodec struct{}
+
+func (Base64HeaderCodec) EncodeKey(key string) (string, error) {
+	return key, validateHeaderKey(key)
+}
+
+func (Base64HeaderCodec) DecodeKey(key string) (string, error) {
+	return key, nil
+}
+
+func (Base64HeaderCodec) EncodeValue(value string) (string, error) {
+	return base64.StdEncoding.EncodeToString([]byte(value)), nil
+}
+
+func (Base64HeaderCodec) DecodeValue(value string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	return string(decoded), err
+}
+
+// HeaderCodecByName returns the built-in codec named raw, query or base64.
+func HeaderCodecByName(name string) (HeaderCodec, error) {
+	switch name {
+	case "raw":
+		return RawHeaderCodec{}, nil
+	case "query":
+		return QueryEscapeHeaderCodec{}, nil
+	case "base64":
+		return Base64HeaderCodec{}, nil
+	}
+	return nil, fmt.Errorf("natspubsub: unknown header codec %q, use one of [raw, query, base64]", name)
+}
+
+// validateHeaderKey rejects keys that can not be written to the header format unchanged.
+func validateHeaderKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w : empty key", ErrInvalidHeader)
+	}
+	for _, c := range key {
+		if c <= ' ' || c == ':' || c == 0x7f {
+			return fmt.Errorf("%w : key %q has a separator, space or control character", ErrInvalidHeader, key)
+		}
+	}
+	return nil
+}
+
+func headerCodecOrDefault(codec HeaderCodec) HeaderCodec {
+	if codec == nil {
+		return QueryEscapeHeaderCodec{}
+	}
+	return codec
+}
+
+// MetadataValueKey is the metadata key holding value index of a header carrying several values.
+// The first value keeps the header name, the following ones are named key[1], key[2] and so on,
+// so that a header with values a and b is received as {key: a, key[1]: b} and published back unchanged.
+func MetadataValueKey(key string, index int) string {
+	if index == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s[%d]", key, index)
+}
+
+// splitValueKey parses a key of the form key[index], reporting false for keys without an index.
+func splitValueKey(key string) (string, int, bool) {
+	if !strings.HasSuffix(key, "]") {
+		return "", 0, false
+	}
+
+	open := strings.LastIndex(key, "[")
+	if open <= 0 {
+		return "", 0, false
+	}
+
+	index, err := strconv.Atoi(key[open+1 : len(key)-1])
+	if err != nil || index < 1 || key[open+1] == '0' || key[open+1] == '+' {
+		return "", 0, false
+	}
+	return key[:open], index, true
+}
+
+// EncodeMetadata converts the metadata of a message to nats headers through codec, query escaping keys and values
+// when codec is nil. Entries named key[1], key[2] and so on become further values of header key,
+// as long as the entries before them are present too, any other entry is a header of its own.
+// HeaderReplyTo is reserved for requests and rejected.
+func EncodeMetadata(metadata map[string]string, codec HeaderCodec) (nats.Header, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+	codec = headerCodecOrDefault(codec)
+
+	header := nats.Header{}
+	for k := range metadata {
+		if k == HeaderReplyTo {
+			return nil, fmt.Errorf("%w : %s is reserved for requests", ErrInvalidHeader, k)
+		}
+		if isExtraValue(metadata, k) {
+			continue
+		}
+
+		key := k
+		if !IsRawHeader(k) {
+			var err error
+			if key, err = codec.EncodeKey(k); err != nil {
+				return nil, err
+			}
+		}
+
+		for i := 0; ; i++ {
+			value, ok := metadata[MetadataValueKey(k, i)]
+			if !ok {
+				break
+			}
+			if !IsRawHeader(k) {
+				var err error
+				if value, err = codec.EncodeValue(value); err != nil {
+					return nil, err
+				}
+			}
+			header[key] = append(header[key], value)
+		}
+	}
+	return header, nil
+}
+
+// isExtraValue reports whether the metadata entry named key is published as a further value of another header.
+func isExtraValue(metadata map[string]string, key string) bool {
+	base, index, ok := splitValueKey(key)
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < index; i++ {
+		if _, present := metadata[MetadataValueKey(base, i)]; !present {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeHeader converts nats headers to message metadata through codec, the reverse of EncodeMetadata.
+// Every value of a header is kept, see MetadataValueKey. Headers decoding to the same metadata entry,
+// such as a header named key[1] next to a header key with several values, are rejected with ErrInvalidHeader.
+func DecodeHeader(header nats.Header, codec HeaderCodec) (map[string]string, error) {
+	if header == nil {
+		return nil, nil
+	}
+	codec = headerCodecOrDefault(codec)
+
+	metadata := map[string]string{}
+	add := func(key string, value string) error {
+		if _, ok := metadata[key]; ok {
+			return fmt.Errorf("%w : more than one header is received as %q", ErrInvalidHeader, key)
+		}
+		metadata[key] = value
+		return nil
+	}
+
+	for k, values := range header {
+		// Like the reply subject, the reply header of a request belongs to the transport rather than the metadata.
+		if k == HeaderReplyTo {
+			continue
+		}
+
+		key := k
+		if !IsRawHeader(k) {
+			var err error
+			if key, err = codec.DecodeKey(k); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(values) == 0 {
+			if err := add(key, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for i, v := range values {
+			if !IsRawHeader(k) {
+				var err error
+				if v, err = codec.DecodeValue(v); err != nil {
+					return nil, err
+				}
+			}
+			if err := add(MetadataValueKey(key, i), v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return metadata, nil
+}
@@ -3,21 +3,57 @@ package connections
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"gocloud.dev/pubsub/driver"
-	"net/url"
-	"strconv"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultInactiveThreshold is how long ephemeral consumers are kept around without any pull requests.
+const defaultInactiveThreshold = 5 * time.Minute
+
+// defaultBatchFetchTimeout is how long a pull waits for messages when no timeout is configured.
+const defaultBatchFetchTimeout = 10 * time.Second
+
+// minBatchFetchTimeout keeps pulls valid when the context deadline is about to pass.
+const minBatchFetchTimeout = time.Millisecond
+
+// ErrConsumerNameMismatch is returned when both a consumer name and a durable name are set but differ.
+var ErrConsumerNameMismatch = errors.New("natspubsub: consumer name and durable queue name do not match")
+
+// ErrConflictingStartPosition is returned when a replay is requested from both a sequence and a time.
+var ErrConflictingStartPosition = errors.New("natspubsub: only one of start sequence or start time can be set")
+
+// ErrConsumerNotDurable is returned when trying to reset the position of a consumer that is not durable.
+var ErrConsumerNotDurable = errors.New("natspubsub: only durable consumers can be reset")
+
+// ErrInvalidLeaseFraction is returned when the lease renewal fraction is not between 0 and 1.
+var ErrInvalidLeaseFraction = errors.New("natspubsub: lease renewal fraction has to be between 0 and 1")
+
 func NewJetstream(js jetstream.JetStream) Connection {
 	return &jetstreamConnection{jetStream: js}
 }
 
+// NewJetstreamFromConn creates a jetstream connection on top of natsConn.
+// Unlike NewJetstream, its topics can send requests and its received messages can be replied to.
+func NewJetstreamFromConn(natsConn *nats.Conn) (Connection, error) {
+	js, err := jetstream.New(natsConn)
+	if err != nil {
+		return nil, err
+	}
+	return &jetstreamConnection{jetStream: js, natsConnection: natsConn}, nil
+}
+
 type jetstreamConnection struct {
 	// Connection to use for communication with the server.
 	jetStream jetstream.JetStream
+	// natsConnection carries requests and replies, which are not stored in streams. It is nil when unknown.
+	natsConnection *nats.Conn
 }
 
 func (c *jetstreamConnection) Raw() interface{} {
@@ -26,16 +62,47 @@ func (c *jetstreamConnection) Raw() interface{} {
 
 func (c *jetstreamConnection) CreateTopic(ctx context.Context, opts *TopicOptions) (Topic, error) {
 
-	return &jetstreamTopic{subject: opts.Subject, jetStream: c.jetStream}, nil
+	if opts.ScheduleStream != "" {
+		if err := ensureScheduleStream(ctx, c.jetStream, opts.ScheduleStream); err != nil {
+			return nil, err
+		}
+	}
+
+	var topic Topic = &jetstreamTopic{
+		subject:      opts.Subject,
+		jetStream:    c.jetStream,
+		natsConn:     c.natsConnection,
+		maxPending:   opts.MaxPendingPublishes,
+		asyncRetries: opts.AsyncPublishRetries,
+		concurrency:  opts.PublishConcurrency,
+
+		scheduleStream: opts.ScheduleStream,
+		retry:          opts.PublishRetry,
+		headerCodec:    opts.HeaderCodec,
+	}
+
+	if opts.Outbox != nil {
+		return NewOutboxTopic(topic, c.natsConnection, *opts.Outbox)
+	}
+	return topic, nil
 }
 
 func (c *jetstreamConnection) CreateSubscription(ctx context.Context, opts *SubscriptionOptions) (Queue, error) {
 
 	setupOpts := opts.SetupOpts
 
+	if opts.LeaseRenewalFraction < 0 || opts.LeaseRenewalFraction >= 1 {
+		return nil, fmt.Errorf("%w : %v", ErrInvalidLeaseFraction, opts.LeaseRenewalFraction)
+	}
+
+	cfg, err := consumerConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	stream, err := c.jetStream.Stream(ctx, setupOpts.StreamName)
 	if err != nil &&
-		errors.Is(err, nats.ErrStreamNotFound) {
+		!errors.Is(err, jetstream.ErrStreamNotFound) {
 		return nil, err
 	}
 
@@ -55,42 +122,306 @@ func (c *jetstreamConnection) CreateSubscription(ctx context.Context, opts *Subs
 
 	}
 
-	// Create durable consumer
-	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Name:      setupOpts.StreamName,
-		Durable:   setupOpts.DurableQueue,
-		AckPolicy: jetstream.AckExplicitPolicy,
-	})
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &jetstreamConsumer{consumer: consumer, batchFetchTimeout: time.Duration(opts.ConsumerMaxBatchTimeoutMs) * time.Millisecond}, nil
+	var deadLetters *deadLetterRouter
+	if opts.DeadLetterSubject != "" {
+		deadLetters, err = newDeadLetterRouter(ctx, c.jetStream, stream, consumer.CachedInfo(),
+			opts.DeadLetterSubject, cfg.Durable == "", opts.ErrorHandler)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var leases *leaseKeeper
+	if opts.LeaseRenewalFraction > 0 {
+		leases = newLeaseKeeper(consumer.CachedInfo().Config.AckWait, opts.LeaseRenewalFraction, opts.LeaseMaxDuration)
+	}
+
+	// Messages parked beyond the batch count of a byte bound fetch are kept alive until they are handed out.
+	var parked *leaseKeeper
+	if opts.ConsumerMaxBatchBytesSize > 0 {
+		parked = newLeaseKeeper(consumer.CachedInfo().Config.AckWait, parkedLeaseFraction, 0)
+	}
+
+	jc := &jetstreamConsumer{
+		natsConn:          c.natsConnection,
+		parked:            parked,
+		leases:            leases,
+		deadLetters:       deadLetters,
+		consumer:          consumer,
+		batchFetchTimeout: time.Duration(opts.ConsumerMaxBatchTimeoutMs) * time.Millisecond,
+		batchMaxBytes:     opts.ConsumerMaxBatchBytesSize,
+		ackMode:           opts.AckMode,
+		redeliveryPolicy:  opts.RedeliveryPolicy,
+
+		terminateUndecodable: opts.TerminateUndecodable,
+		headerCodec:          opts.HeaderCodec,
+	}
+	if opts.AckMode == AckAsync {
+		jc.asyncAcks = newAsyncAcker(jc.addAsyncError)
+	}
+	return jc, nil
+
+}
+
+// ResetConsumer implements ConsumerResetter.ResetConsumer.
+// The deliver policy of a consumer can not be updated in place, so the durable consumer is
+// deleted and created again starting from the new position. Open subscriptions address the
+// consumer by name and carry on from the new position once it is recreated.
+func (c *jetstreamConnection) ResetConsumer(ctx context.Context, opts *SubscriptionOptions) error {
+
+	cfg, err := consumerConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Durable == "" {
+		return ErrConsumerNotDurable
+	}
+
+	stream, err := c.jetStream.Stream(ctx, opts.SetupOpts.StreamName)
+	if err != nil {
+		return err
+	}
+
+	err = stream.DeleteConsumer(ctx, cfg.Durable)
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return err
+	}
+
+	_, err = stream.CreateConsumer(ctx, cfg)
+	return err
+}
+
+// consumerConfig derives the consumer settings from the subscription options.
+// A durable consumer is created whenever a DurableQueue is supplied, otherwise the consumer is
+// ephemeral and gets removed by the server once it has been inactive for the configured threshold.
+// This allows several independent subscriptions to each receive every message on one stream.
+func consumerConfig(opts *SubscriptionOptions) (jetstream.ConsumerConfig, error) {
+
+	setupOpts := opts.SetupOpts
+
+	name := setupOpts.ConsumerName
+	durable := setupOpts.DurableQueue
+
+	if name != "" && durable != "" && name != durable {
+		return jetstream.ConsumerConfig{}, fmt.Errorf("%w : name [%s] durable [%s]", ErrConsumerNameMismatch, name, durable)
+	}
+
+	cfg := jetstream.ConsumerConfig{
+		Name:              name,
+		Durable:           durable,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		InactiveThreshold: time.Duration(setupOpts.ConsumerInactiveThresholdMs) * time.Millisecond,
+	}
+
+	cfg.AckWait = setupOpts.ConsumerAckWait
+	if setupOpts.ConsumerMaxDeliver > 0 {
+		cfg.MaxDeliver = setupOpts.ConsumerMaxDeliver
+	}
+	cfg.BackOff = setupOpts.ConsumerBackOff
+
+	if durable != "" {
+		cfg.Name = durable
+	} else if cfg.InactiveThreshold <= 0 {
+		cfg.InactiveThreshold = defaultInactiveThreshold
+	}
+
+	cfg.DeliverPolicy = opts.DeliverPolicy
+	switch {
+	case opts.StartSequence > 0 && opts.StartTime != nil:
+		return jetstream.ConsumerConfig{}, ErrConflictingStartPosition
+	case opts.StartSequence > 0:
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = opts.StartSequence
+	case opts.StartTime != nil:
+		cfg.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		cfg.OptStartTime = opts.StartTime
+	}
+
+	// A single filter is kept on FilterSubject so that servers older than 2.10 are still supported.
+	switch len(setupOpts.FilterSubjects) {
+	case 0:
+	case 1:
+		cfg.FilterSubject = setupOpts.FilterSubjects[0]
+	default:
+		cfg.FilterSubjects = setupOpts.FilterSubjects
+	}
 
+	return cfg, nil
 }
 
 type jetstreamTopic struct {
 	subject   string
 	jetStream jetstream.JetStream
+	natsConn  *nats.Conn
+
+	// maxPending bounds the asynchronous publishes awaiting acknowledgement, zero publishes synchronously.
+	maxPending   int
+	asyncRetries int
+	concurrency  int
+
+	// scheduleStream holds messages carrying a due time until a Scheduler delivers them, empty when disabled.
+	scheduleStream string
+	// retry retries publishes failing while the stream is unavailable, the async publishes have their own retries.
+	retry PublishRetryPolicy
+	// headerCodec decodes the deliver-at metadata of scheduled messages and the headers of replies.
+	headerCodec HeaderCodec
 }
 
 func (t *jetstreamTopic) Subject() string {
 	return t.subject
 }
 
-func (t *jetstreamTopic) PublishMessage(ctx context.Context, msg *nats.Msg) (string, error) {
-	var ack *jetstream.PubAck
-	var err error
-	if ack, err = t.jetStream.PublishMsg(ctx, msg); err != nil {
-		return "", err
+func (t *jetstreamTopic) PublishMessage(ctx context.Context, msg *nats.Msg) (*jetstream.PubAck, error) {
+	if err := scheduleMessage(t.scheduleStream, msg, t.headerCodec); err != nil {
+		return nil, err
+	}
+	if t.retry.Attempts > 1 {
+		return publishWithRetry(ctx, t.jetStream, msg, t.retry)
 	}
+	return t.jetStream.PublishMsg(ctx, msg)
+}
 
-	return strconv.Itoa(int(ack.Sequence)), nil
+// Request implements Requester.Request, the request is stored in the stream and replies arrive over core nats.
+func (t *jetstreamTopic) Request(ctx context.Context, msg *nats.Msg, count int) ([]*driver.Message, error) {
+	return request(ctx, t.natsConn, t, msg, count, t.headerCodec)
+}
+
+// PublishMessages implements BatchPublisher.PublishMessages.
+// Without a pending limit every message waits for its acknowledgement, with up to the publish concurrency sent at once.
+func (t *jetstreamTopic) PublishMessages(ctx context.Context, msgs []*nats.Msg) ([]*jetstream.PubAck, error) {
+	if t.maxPending <= 0 {
+		return publishConcurrently(ctx, t, msgs, t.concurrency)
+	}
+
+	acks := make([]*jetstream.PubAck, len(msgs))
+
+	// As with publishWithRetry, the stream drops retries of messages it did store whose acknowledgement was lost.
+	if t.asyncRetries > 0 {
+		for _, msg := range msgs {
+			setMsgID(msg)
+		}
+	}
+
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	var failed map[int]error
+	for attempt := 0; attempt <= t.asyncRetries && len(pending) > 0; attempt++ {
+
+		failed = t.publishAsync(ctx, msgs, pending, acks)
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Failed messages are retried in the order they were given.
+		pending = pending[:0]
+		for i := range failed {
+			pending = append(pending, i)
+		}
+		slices.Sort(pending)
+	}
+
+	if len(failed) > 0 {
+		return acks, &PublishBatchError{Failed: failed}
+	}
+	return acks, nil
+}
+
+// publishAsync sends the messages at positions without waiting for each acknowledgement,
+// holding back once maxPending messages are in flight. The acknowledgements of the published
+// messages are stored in acks, the errors of the rest are returned by position.
+func (t *jetstreamTopic) publishAsync(ctx context.Context, msgs []*nats.Msg, positions []int, acks []*jetstream.PubAck) map[int]error {
+	failed := map[int]error{}
+	var failedMutex sync.Mutex
+	fail := func(i int, err error) {
+		failedMutex.Lock()
+		defer failedMutex.Unlock()
+		failed[i] = err
+	}
+
+	window := make(chan struct{}, t.maxPending)
+	var wg sync.WaitGroup
+	for _, i := range positions {
+
+		select {
+		case window <- struct{}{}:
+		case <-ctx.Done():
+			fail(i, ctx.Err())
+			continue
+		}
+
+		err := scheduleMessage(t.scheduleStream, msgs[i], t.headerCodec)
+		if err != nil {
+			<-window
+			fail(i, err)
+			continue
+		}
+
+		future, err := t.jetStream.PublishMsgAsync(msgs[i])
+		if err != nil {
+			<-window
+			fail(i, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, future jetstream.PubAckFuture) {
+			defer wg.Done()
+			defer func() { <-window }()
+
+			select {
+			case ack := <-future.Ok():
+				acks[i] = ack
+			case err := <-future.Err():
+				fail(i, err)
+			case <-ctx.Done():
+				fail(i, ctx.Err())
+			}
+		}(i, future)
+	}
+	wg.Wait()
+
+	return failed
 }
 
 type jetstreamConsumer struct {
+	natsConn          *nats.Conn
 	consumer          jetstream.Consumer
 	batchFetchTimeout time.Duration
+	// batchMaxBytes caps the size of each pull, when set fetching is bound by bytes instead of message count.
+	batchMaxBytes int
+
+	// pending holds messages pulled by a byte bound fetch beyond the requested batch count, parked extends
+	// their ack deadline until they are handed out. Once unsubscribed they are handed back for redelivery.
+	pendingMutex  sync.Mutex
+	pending       []jetstream.Msg
+	pendingClosed bool
+	parked        *leaseKeeper
+
+	ackMode          AckMode
+	redeliveryPolicy RedeliveryPolicy
+	skipped          atomic.Uint64
+	terminated       atomic.Uint64
+
+	terminateUndecodable bool
+	headerCodec          HeaderCodec
+	// leases extends the ack deadline of messages not yet acked or nacked, it is nil unless enabled.
+	leases *leaseKeeper
+	// deadLetters routes messages that reached the maximum deliveries to a dead letter subject, it is nil unless enabled.
+	deadLetters *deadLetterRouter
+
+	// asyncAcks confirms acknowledgements in the background, it is nil unless the ack mode is AckAsync.
+	asyncAcks     *asyncAcker
+	asyncErrMutex sync.Mutex
+	asyncErrs     []error
 }
 
 func (jc *jetstreamConsumer) IsDurable() bool {
@@ -98,6 +429,19 @@ func (jc *jetstreamConsumer) IsDurable() bool {
 }
 
 func (jc *jetstreamConsumer) Unsubscribe() error {
+	if jc.parked != nil {
+		jc.parked.stop()
+	}
+	jc.nakPending()
+	if jc.leases != nil {
+		jc.leases.stop()
+	}
+	if jc.asyncAcks != nil {
+		jc.asyncAcks.stop()
+	}
+	if jc.deadLetters != nil {
+		return jc.deadLetters.stop()
+	}
 	return nil
 }
 
@@ -109,93 +453,420 @@ func (jc *jetstreamConsumer) ReceiveMessages(ctx context.Context, batchCount int
 		batchCount = 1
 	}
 
-	msgBatch, err := jc.consumer.Fetch(batchCount, jetstream.FetchMaxWait(jc.batchFetchTimeout))
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	for msg := range msgBatch.Messages() {
+	msgs := jc.takePending(batchCount)
+	if len(msgs) == 0 {
 
-		driverMsg, err0 := decodeJetstreamMessage(msg)
+		fetchWait := jc.fetchWait(ctx)
+		expires := time.Now().Add(fetchWait)
+
+		var msgBatch jetstream.MessageBatch
+		var err error
+		if jc.batchMaxBytes > 0 {
+			msgBatch, err = jc.consumer.FetchBytes(jc.batchMaxBytes, jetstream.FetchMaxWait(fetchWait))
+		} else {
+			msgBatch, err = jc.consumer.Fetch(batchCount, jetstream.FetchMaxWait(fetchWait))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msgs, err = collectMessages(ctx, msgBatch, expires)
+		if err != nil {
+			return nil, err
+		}
+
+		// A single message bigger than the byte cap can never be delivered, so it is reported.
+		if len(msgs) == 0 && errors.Is(msgBatch.Error(), jetstream.ErrMaxBytesExceeded) {
+			return nil, msgBatch.Error()
+		}
+
+		// A byte bound fetch can not be limited by count as well, so messages beyond the batch are parked
+		// for the next receive. Handing them back would use up one of their deliveries every time.
+		if len(msgs) > batchCount {
+			jc.putPending(msgs[batchCount:])
+			msgs = msgs[:batchCount]
+		}
+	}
+
+	decoded := make([]jetstream.Msg, 0, len(msgs))
+	for _, msg := range msgs {
+
+		// The reply subject of jetstream messages is used for acknowledgements, so requests name theirs in a header.
+		responder := newResponder(jc.natsConn, msg.Headers(), "")
+		driverMsg, err0 := decodeJetstreamMessage(msg, messageTerminator{consumer: jc, msg: msg}, responder, jc.headerCodec)
 
 		if err0 != nil {
-			return nil, err0
+			if !jc.terminateUndecodable {
+				jc.recordDeadLetterError(msg, err0, 0)
+				return nil, err0
+			}
+
+			err0 = jc.terminate(msg, fmt.Sprintf("message could not be decoded : %v", err0))
+			if err0 != nil {
+				return nil, err0
+			}
+			continue
 		}
 
+		// Until the message is acked or nacked, running out of deliveries means its ack wait expired.
+		jc.recordDeadLetterError(msg, errDeadLetterAckWait, 0)
+		decoded = append(decoded, msg)
 		messages = append(messages, driverMsg)
 	}
 
+	if jc.leases != nil {
+		jc.leases.track(decoded...)
+	}
+
 	return messages, nil
 }
 
-func (jc *jetstreamConsumer) Ack(ctx context.Context, ids []driver.AckID) error {
+// fetchWait is how long a pull may wait for messages, it never outlasts the deadline of ctx.
+func (jc *jetstreamConsumer) fetchWait(ctx context.Context) time.Duration {
+	wait := jc.batchFetchTimeout
+	if wait <= 0 {
+		wait = defaultBatchFetchTimeout
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if untilDeadline := time.Until(deadline); untilDeadline < wait {
+			wait = untilDeadline
+		}
+	}
+
+	if wait < minBatchFetchTimeout {
+		wait = minBatchFetchTimeout
+	}
+	return wait
+}
+
+// collectMessages gathers the messages of a running pull that ends at expires, stopping as soon as ctx is done.
+// The client can not cancel a pull, so the abandoned one is drained until it ends. Anything it delivered is handed back
+// with a delay lasting until then, as a message handed back at once would be delivered to the same abandoned pull again.
+// Each message handed back this way used up one delivery, which counts towards ConsumerMaxDeliver.
+func collectMessages(ctx context.Context, msgBatch jetstream.MessageBatch, expires time.Time) ([]jetstream.Msg, error) {
+	var msgs []jetstream.Msg
+	for {
+		select {
+		case msg, ok := <-msgBatch.Messages():
+			if !ok {
+				return msgs, nil
+			}
+			msgs = append(msgs, msg)
+		case <-ctx.Done():
+			go func() {
+				for _, msg := range msgs {
+					_ = nakUntil(msg, expires)
+				}
+				for msg := range msgBatch.Messages() {
+					_ = nakUntil(msg, expires)
+				}
+			}()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// nakUntil asks for msg to be redelivered once the given time has passed.
+func nakUntil(msg jetstream.Msg, until time.Time) error {
+	if delay := time.Until(until); delay > 0 {
+		return msg.NakWithDelay(delay)
+	}
+	return msg.Nak()
+}
+
+// takePending removes up to batchCount messages parked by an earlier fetch.
+func (jc *jetstreamConsumer) takePending(batchCount int) []jetstream.Msg {
+	jc.pendingMutex.Lock()
+	defer jc.pendingMutex.Unlock()
+
+	if batchCount > len(jc.pending) {
+		batchCount = len(jc.pending)
+	}
+
+	msgs := jc.pending[:batchCount:batchCount]
+	jc.pending = jc.pending[batchCount:]
+	if jc.parked != nil {
+		jc.parked.release(msgs...)
+	}
+	return msgs
+}
+
+// putPending parks msgs for a later receive, or hands them back once unsubscribed.
+func (jc *jetstreamConsumer) putPending(msgs []jetstream.Msg) {
+	jc.pendingMutex.Lock()
+	defer jc.pendingMutex.Unlock()
+
+	if jc.pendingClosed {
+		for _, msg := range msgs {
+			_ = msg.Nak()
+		}
+		return
+	}
+
+	jc.pending = append(jc.pending, msgs...)
+	if jc.parked != nil {
+		jc.parked.track(msgs...)
+	}
+}
+
+// nakPending hands the parked messages back for redelivery, as they will not be received here anymore.
+func (jc *jetstreamConsumer) nakPending() {
+	jc.pendingMutex.Lock()
+	defer jc.pendingMutex.Unlock()
+
+	jc.pendingClosed = true
+	for _, msg := range jc.pending {
+		_ = msg.Nak()
+	}
+	jc.pending = nil
+}
+
+// Skipped implements SkippedCounter.Skipped.
+func (jc *jetstreamConsumer) Skipped() uint64 {
+	return jc.skipped.Load()
+}
+
+// ackMessages picks the jetstream messages out of ids, counting any id of another type as skipped.
+func (jc *jetstreamConsumer) ackMessages(ids []driver.AckID) []jetstream.Msg {
+	msgs := make([]jetstream.Msg, 0, len(ids))
 	for _, id := range ids {
 		msg, ok := id.(jetstream.Msg)
 		if !ok {
+			jc.skipped.Add(1)
 			continue
 		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
 
-		// We don;t use DoubleAck as it fails conformance tests
-		_ = msg.DoubleAck(ctx)
+func (jc *jetstreamConsumer) Ack(ctx context.Context, ids []driver.AckID) error {
+
+	msgs := jc.ackMessages(ids)
+	if jc.leases != nil {
+		jc.leases.release(msgs...)
 	}
+	jc.forgetDeadLetterErrors(msgs...)
 
-	return nil
+	switch jc.ackMode {
+	case AckFireAndForget:
+		var errs []error
+		for _, msg := range msgs {
+			errs = append(errs, ackError(msg.Ack()))
+		}
+		return errors.Join(errs...)
+
+	case AckAsync:
+		// Failures of earlier acknowledgements are reported now, the current ones are confirmed in the background.
+		errs := []error{jc.takeAsyncErrors()}
+		for _, msg := range msgs {
+			errs = append(errs, jc.asyncAcks.ack(ctx, msg))
+		}
+		return errors.Join(errs...)
+
+	default:
+		errs := make([]error, len(msgs))
+		var wg sync.WaitGroup
+		for i, msg := range msgs {
+			wg.Add(1)
+			go func(i int, msg jetstream.Msg) {
+				defer wg.Done()
+				errs[i] = ackError(msg.DoubleAck(ctx))
+				if errs[i] != nil {
+					jc.recordDeadLetterError(msg, errs[i], 0)
+				}
+			}(i, msg)
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	}
 }
 
 func (jc *jetstreamConsumer) Nack(ctx context.Context, ids []driver.AckID) error {
 
-	for _, id := range ids {
-		msg, ok := id.(jetstream.Msg)
-		if !ok {
+	msgs := jc.ackMessages(ids)
+	if jc.leases != nil {
+		jc.leases.release(msgs...)
+	}
+
+	var errs []error
+	for _, msg := range msgs {
+		delay, err := jc.redeliveryDelay(msg)
+		if err != nil {
+			errs = append(errs, ackError(err))
 			continue
 		}
+		jc.recordDeadLetterError(msg, errDeadLetterNacked, delay)
+		errs = append(errs, ackError(jc.nak(msg, delay)))
+	}
 
-		_ = msg.Nak()
+	return errors.Join(errs...)
+}
+
+// Terminated implements TerminatedCounter.Terminated.
+func (jc *jetstreamConsumer) Terminated() uint64 {
+	return jc.terminated.Load()
+}
 
+// terminate tells the server to stop redelivering msg, logging its stream sequence along with the reason.
+func (jc *jetstreamConsumer) terminate(msg jetstream.Msg, reason string) error {
+	if jc.leases != nil {
+		jc.leases.release(msg)
 	}
 
+	err := msg.Term()
+	if err != nil {
+		return err
+	}
+
+	jc.terminated.Add(1)
+	jc.forgetDeadLetterErrors(msg)
+
+	var sequence uint64
+	var stream string
+	if metadata, err0 := msg.Metadata(); err0 == nil {
+		sequence = metadata.Sequence.Stream
+		stream = metadata.Stream
+	}
+	log.Printf("natspubsub: terminated message [%s:%d] on subject %s : %s", stream, sequence, msg.Subject(), reason)
+
 	return nil
 }
 
-func jsMessageAsFunc(msg jetstream.Msg) func(interface{}) bool {
+// messageTerminator binds a received message to the consumer that can terminate it.
+type messageTerminator struct {
+	consumer *jetstreamConsumer
+	msg      jetstream.Msg
+}
+
+func (t messageTerminator) Terminate(reason string) error {
+	return t.consumer.terminate(t.msg, reason)
+}
+
+// recordDeadLetterError keeps the reason msg failed, so it can be reported if the message ends up dead lettered
+// once redelivered after delay.
+func (jc *jetstreamConsumer) recordDeadLetterError(msg jetstream.Msg, err error, delay time.Duration) {
+	if jc.deadLetters == nil {
+		return
+	}
+
+	metadata, err0 := msg.Metadata()
+	if err0 != nil {
+		return
+	}
+	jc.deadLetters.recordError(metadata.Sequence.Stream, err, delay)
+}
+
+// forgetDeadLetterErrors drops the errors recorded for msgs, as they will not be dead lettered any more.
+func (jc *jetstreamConsumer) forgetDeadLetterErrors(msgs ...jetstream.Msg) {
+	if jc.deadLetters == nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		if metadata, err := msg.Metadata(); err == nil {
+			jc.deadLetters.forgetError(metadata.Sequence.Stream)
+		}
+	}
+}
+
+// redeliveryDelay is the wait the redelivery policy gives msg before it is redelivered, zero without a policy.
+func (jc *jetstreamConsumer) redeliveryDelay(msg jetstream.Msg) (time.Duration, error) {
+	if jc.redeliveryPolicy == nil {
+		return 0, nil
+	}
+
+	metadata, err := msg.Metadata()
+	if err != nil {
+		return 0, err
+	}
+	return jc.redeliveryPolicy.Delay(metadata.NumDelivered), nil
+}
+
+// nak asks for the message to be redelivered, after delay when it is positive.
+func (jc *jetstreamConsumer) nak(msg jetstream.Msg, delay time.Duration) error {
+	if delay <= 0 {
+		return msg.Nak()
+	}
+	return msg.NakWithDelay(delay)
+}
+
+func (jc *jetstreamConsumer) addAsyncError(err error) {
+	if err == nil {
+		return
+	}
+
+	jc.asyncErrMutex.Lock()
+	defer jc.asyncErrMutex.Unlock()
+
+	jc.asyncErrs = append(jc.asyncErrs, err)
+}
+
+func (jc *jetstreamConsumer) takeAsyncErrors() error {
+	jc.asyncErrMutex.Lock()
+	defer jc.asyncErrMutex.Unlock()
+
+	err := errors.Join(jc.asyncErrs...)
+	jc.asyncErrs = nil
+	return err
+}
+
+// ackError drops the errors of messages that were already acknowledged,
+// acknowledging a message more than once is allowed and should not fail.
+func ackError(err error) error {
+	if errors.Is(err, jetstream.ErrMsgAlreadyAckd) {
+		return nil
+	}
+	return err
+}
+
+func jsMessageAsFunc(msg jetstream.Msg, terminator Terminator, responder Responder, codec HeaderCodec) func(interface{}) bool {
 	return func(i interface{}) bool {
-		if p, ok := i.(*jetstream.Msg); ok {
+		switch p := i.(type) {
+		case *jetstream.Msg:
 			*p = msg
 			return true
+		case *nats.Header:
+			*p = msg.Headers()
+			return true
+		case *HeaderCodec:
+			*p = headerCodecOrDefault(codec)
+			return true
+		case *Terminator:
+			*p = terminator
+			return true
+		case *Responder:
+			if responder == nil {
+				return false
+			}
+			*p = responder
+			return true
 		}
 
 		return false
 	}
 }
 
-func decodeJetstreamMessage(msg jetstream.Msg) (*driver.Message, error) {
+func decodeJetstreamMessage(msg jetstream.Msg, terminator Terminator, responder Responder, codec HeaderCodec) (*driver.Message, error) {
 	if msg == nil {
 		return nil, nats.ErrInvalidMsg
 	}
 
 	dm := driver.Message{
-		AsFunc: jsMessageAsFunc(msg),
+		AsFunc: jsMessageAsFunc(msg, terminator, responder, codec),
 		Body:   msg.Data(),
 	}
 
-	if msg.Headers() != nil {
-		dm.Metadata = map[string]string{}
-		for k, v := range msg.Headers() {
-			var sv string
-			if len(v) > 0 {
-				sv = v[0]
-			}
-			kb, err := url.QueryUnescape(k)
-			if err != nil {
-				return nil, err
-			}
-			vb, err := url.QueryUnescape(sv)
-			if err != nil {
-				return nil, err
-			}
-			dm.Metadata[kb] = vb
-		}
+	metadata, err := DecodeHeader(msg.Headers(), codec)
+	if err != nil {
+		return nil, err
 	}
+	dm.Metadata = metadata
 
 	dm.AckID = msg
 
@@ -0,0 +1,113 @@
+package connections
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go/jetstream"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAckWait is the server side ack wait of consumers configured without one.
+	defaultAckWait = 30 * time.Second
+	// parkedLeaseFraction is the fraction of the ack wait after which parked messages report progress.
+	parkedLeaseFraction = 0.5
+)
+
+// leaseKeeper extends the ack deadline of messages that were handed out but not yet acked or nacked,
+// so that long running handlers do not get their messages redelivered to another worker.
+// Progress is reported for every tracked message each interval, until it is released or held for maxLease.
+type leaseKeeper struct {
+	interval time.Duration
+	maxLease time.Duration
+
+	mutex   sync.Mutex
+	leases  map[jetstream.Msg]time.Time
+	running bool
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newLeaseKeeper(ackWait time.Duration, fraction float64, maxLease time.Duration) *leaseKeeper {
+	if ackWait <= 0 {
+		ackWait = defaultAckWait
+	}
+
+	return &leaseKeeper{
+		interval: time.Duration(float64(ackWait) * fraction),
+		maxLease: maxLease,
+		leases:   map[jetstream.Msg]time.Time{},
+		stopped:  make(chan struct{}),
+	}
+}
+
+// track starts extending the lease of msgs, the renewal loop only runs while there are leases to keep.
+func (lk *leaseKeeper) track(msgs ...jetstream.Msg) {
+	lk.mutex.Lock()
+	defer lk.mutex.Unlock()
+
+	now := time.Now()
+	for _, msg := range msgs {
+		lk.leases[msg] = now
+	}
+
+	if !lk.running && len(lk.leases) > 0 {
+		lk.running = true
+		go lk.run()
+	}
+}
+
+// release stops extending the lease of msgs, as they have been acked or nacked.
+func (lk *leaseKeeper) release(msgs ...jetstream.Msg) {
+	lk.mutex.Lock()
+	defer lk.mutex.Unlock()
+
+	for _, msg := range msgs {
+		delete(lk.leases, msg)
+	}
+}
+
+func (lk *leaseKeeper) stop() {
+	lk.once.Do(func() { close(lk.stopped) })
+}
+
+func (lk *leaseKeeper) run() {
+	ticker := time.NewTicker(lk.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lk.stopped:
+			return
+		case <-ticker.C:
+			if !lk.renew() {
+				return
+			}
+		}
+	}
+}
+
+// renew reports progress on every lease still held, it returns false once no leases are left.
+func (lk *leaseKeeper) renew() bool {
+	lk.mutex.Lock()
+	defer lk.mutex.Unlock()
+
+	now := time.Now()
+	for msg, since := range lk.leases {
+		if lk.maxLease > 0 && now.Sub(since) >= lk.maxLease {
+			delete(lk.leases, msg)
+			continue
+		}
+
+		err := msg.InProgress()
+		if errors.Is(err, jetstream.ErrMsgAlreadyAckd) {
+			delete(lk.leases, msg)
+		}
+	}
+
+	if len(lk.leases) == 0 {
+		lk.running = false
+		return false
+	}
+	return true
+}
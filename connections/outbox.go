@@ -0,0 +1,451 @@
+package connections
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"gocloud.dev/pubsub/driver"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxFileName   = "outbox.wal"
+	outboxOffsetName = "outbox.offset"
+	outboxOffsetTemp = "outbox.offset.tmp"
+
+	defaultOutboxRelayInterval = time.Second
+	defaultOutboxRelayTimeout  = 10 * time.Second
+)
+
+// ErrOutboxFull is returned when a message can not be stored because the outbox reached its MaxBytes.
+var ErrOutboxFull = errors.New("natspubsub: outbox is full")
+
+// OutboxOptions sets options for the disk backed outbox of a topic.
+type OutboxOptions struct {
+	// Dir is the directory the outbox files are kept in, it is created when missing.
+	// Every topic needs a directory of its own.
+	Dir string
+	// MaxBytes limits the size of the messages waiting in the outbox, zero leaves it unlimited.
+	MaxBytes int64
+	// MaxAge drops messages that waited longer than this in the outbox instead of relaying them, zero keeps them.
+	MaxAge time.Duration
+	// RelayInterval is how often the outbox is checked for messages to relay, defaults to 1s.
+	RelayInterval time.Duration
+	// ErrorHandler is given the errors of the relay and the messages it dropped, they are dropped too when it is nil.
+	ErrorHandler func(error)
+}
+
+// outboxRecord is a message as stored in the outbox, one json document per line.
+type outboxRecord struct {
+	Subject string      `json:"subject"`
+	Reply   string      `json:"reply,omitempty"`
+	Header  nats.Header `json:"header,omitempty"`
+	Data    []byte      `json:"data,omitempty"`
+	Stored  time.Time   `json:"stored"`
+}
+
+// OutboxTopic decorates a Topic, storing messages in a local write ahead file while the server can not be reached.
+// A background relay publishes the stored messages in order once the connection is back, before any newer message.
+// Stored messages are given a Nats-Msg-Id, so jetstream drops any relayed twice after a crash.
+type OutboxTopic struct {
+	topic    Topic
+	natsConn *nats.Conn
+
+	maxBytes     int64
+	maxAge       time.Duration
+	errorHandler func(error)
+
+	// mutex guards the write ahead file, where offset is the number of bytes already relayed.
+	mutex      sync.Mutex
+	file       *os.File
+	offsetPath string
+	offsetTemp string
+	offset     int64
+	size       int64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOutboxTopic wraps topic with an outbox kept in opts.Dir, relaying any messages left there by an earlier run.
+// natsConn tells whether the server is reachable, when nil messages are only stored once publishing them fails.
+func NewOutboxTopic(topic Topic, natsConn *nats.Conn, opts OutboxOptions) (*OutboxTopic, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(opts.Dir, outboxFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	t := &OutboxTopic{
+		topic:        topic,
+		natsConn:     natsConn,
+		maxBytes:     opts.MaxBytes,
+		maxAge:       opts.MaxAge,
+		errorHandler: opts.ErrorHandler,
+		file:         file,
+		offsetPath:   filepath.Join(opts.Dir, outboxOffsetName),
+		offsetTemp:   filepath.Join(opts.Dir, outboxOffsetTemp),
+		size:         info.Size(),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if t.offset, err = t.readOffset(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	interval := opts.RelayInterval
+	if interval <= 0 {
+		interval = defaultOutboxRelayInterval
+	}
+	go t.run(interval)
+
+	return t, nil
+}
+
+func (t *OutboxTopic) Subject() string {
+	return t.topic.Subject()
+}
+
+// PublishMessage publishes msg through the wrapped topic, or stores it in the outbox when the server is unreachable
+// or older messages still wait to be relayed. Stored messages have no acknowledgement yet, so nil is returned for them.
+func (t *OutboxTopic) PublishMessage(ctx context.Context, msg *nats.Msg) (*jetstream.PubAck, error) {
+	if t.Pending() == 0 && (t.natsConn == nil || t.natsConn.IsConnected()) {
+		ack, err := t.topic.PublishMessage(ctx, msg)
+		if err == nil || !isUnreachableError(err) {
+			return ack, err
+		}
+	}
+
+	return nil, t.store(msg)
+}
+
+// PublishMessages implements BatchPublisher.PublishMessages, handing the batch to the wrapped topic so its publish options
+// apply, or storing it in the outbox when the server is unreachable or older messages still wait to be relayed.
+// Messages of the batch that failed because the server could not be reached are stored in their order too.
+func (t *OutboxTopic) PublishMessages(ctx context.Context, msgs []*nats.Msg) ([]*jetstream.PubAck, error) {
+	unsent := make([]int, 0, len(msgs))
+	failed := map[int]error{}
+
+	acks := make([]*jetstream.PubAck, len(msgs))
+	if t.Pending() == 0 && (t.natsConn == nil || t.natsConn.IsConnected()) {
+		var published []*jetstream.PubAck
+		var err error
+		if publisher, ok := t.topic.(BatchPublisher); ok {
+			published, err = publisher.PublishMessages(ctx, msgs)
+		} else {
+			published, err = publishConcurrently(ctx, t.topic, msgs, 1)
+		}
+		copy(acks, published)
+
+		var batchErr *PublishBatchError
+		switch {
+		case err == nil:
+			return acks, nil
+		case errors.As(err, &batchErr):
+			for _, i := range batchErr.positions() {
+				if reason := batchErr.Failed[i]; !isUnreachableError(reason) {
+					failed[i] = reason
+				} else {
+					unsent = append(unsent, i)
+				}
+			}
+		case isUnreachableError(err):
+			for i := range msgs {
+				acks[i] = nil
+				unsent = append(unsent, i)
+			}
+		default:
+			return acks, err
+		}
+	} else {
+		for i := range msgs {
+			unsent = append(unsent, i)
+		}
+	}
+
+	for _, i := range unsent {
+		if err := t.store(msgs[i]); err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return acks, &PublishBatchError{Failed: failed}
+	}
+	return acks, nil
+}
+
+// Request implements Requester.Request when the wrapped topic does, replies can not wait in the outbox.
+func (t *OutboxTopic) Request(ctx context.Context, msg *nats.Msg, count int) ([]*driver.Message, error) {
+	requester, ok := t.topic.(Requester)
+	if !ok {
+		return nil, ErrRequestNotSupported
+	}
+	return requester.Request(ctx, msg, count)
+}
+
+// Pending returns the number of bytes of messages waiting in the outbox.
+func (t *OutboxTopic) Pending() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.size - t.offset
+}
+
+// Close stops the relay and closes the outbox, messages still waiting are relayed by the next outbox opened on Dir.
+func (t *OutboxTopic) Close() error {
+	close(t.stop)
+	<-t.done
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.file.Close()
+}
+
+// store appends msg to the write ahead file and wakes the relay up, msg itself is left unchanged.
+func (t *OutboxTopic) store(msg *nats.Msg) error {
+	header := maps.Clone(msg.Header)
+	if header == nil {
+		header = nats.Header{}
+	}
+	if header.Get(jetstream.MsgIDHeader) == "" {
+		header.Set(jetstream.MsgIDHeader, nuid.Next())
+	}
+
+	line, err := json.Marshal(outboxRecord{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  header,
+		Data:    msg.Data,
+		Stored:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.maxBytes > 0 && t.size-t.offset+int64(len(line)) > t.maxBytes {
+		return ErrOutboxFull
+	}
+
+	if _, err = t.file.WriteAt(line, t.size); err != nil {
+		return err
+	}
+	if err = t.file.Sync(); err != nil {
+		return err
+	}
+	t.size += int64(len(line))
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run relays the stored messages every interval, or as soon as a message is stored, until the outbox is closed.
+func (t *OutboxTopic) run(interval time.Duration) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.wake:
+		}
+
+		if err := t.relay(); err != nil {
+			t.reportError(fmt.Errorf("natspubsub: outbox of %s could not relay messages : %w", t.topic.Subject(), err))
+		}
+	}
+}
+
+// relay publishes the stored messages in order, stopping at the first one the server can not be reached for.
+// Messages that fail for any other reason, waited longer than the maximum age or can not be read back, are dropped.
+func (t *OutboxTopic) relay() error {
+	for {
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+
+		if t.natsConn != nil && !t.natsConn.IsConnected() {
+			return nil
+		}
+
+		record, length, err := t.next()
+		if length == 0 {
+			return err
+		}
+
+		if err != nil {
+			t.reportError(fmt.Errorf("natspubsub: outbox of %s dropped a message : %w", t.topic.Subject(), err))
+		} else if t.maxAge > 0 && time.Since(record.Stored) > t.maxAge {
+			t.reportError(fmt.Errorf("natspubsub: outbox of %s dropped a message stored at %v, it is older than %v",
+				t.topic.Subject(), record.Stored, t.maxAge))
+		} else if err = t.publish(record); err != nil {
+			if isUnreachableError(err) {
+				return err
+			}
+			t.reportError(fmt.Errorf("natspubsub: outbox of %s dropped a message that can not be published : %w",
+				t.topic.Subject(), err))
+		}
+
+		if err = t.advance(length); err != nil {
+			return err
+		}
+	}
+}
+
+// publish sends a stored message through the wrapped topic.
+func (t *OutboxTopic) publish(record outboxRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultOutboxRelayTimeout)
+	defer cancel()
+
+	_, err := t.topic.PublishMessage(ctx, &nats.Msg{
+		Subject: record.Subject,
+		Reply:   record.Reply,
+		Header:  record.Header,
+		Data:    record.Data,
+	})
+	return err
+}
+
+// next reads the oldest message waiting in the outbox, a zero length means none is waiting.
+// A partly written message left by a crash is cut off, as it was never reported as stored.
+// A message that can not be read back is returned with its length and an error, so that it can be skipped.
+func (t *OutboxTopic) next() (outboxRecord, int64, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var record outboxRecord
+	if t.offset >= t.size {
+		return record, 0, t.compact()
+	}
+
+	line, err := bufio.NewReader(io.NewSectionReader(t.file, t.offset, t.size-t.offset)).ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		t.reportError(fmt.Errorf("natspubsub: outbox of %s cut off %d bytes of an incomplete message",
+			t.topic.Subject(), len(line)))
+		t.size = t.offset
+		return record, 0, t.file.Truncate(t.size)
+	}
+	if err != nil {
+		return record, 0, err
+	}
+
+	if err = json.Unmarshal(line, &record); err != nil {
+		return record, int64(len(line)), fmt.Errorf("natspubsub: outbox record at offset %d is corrupt : %w", t.offset, err)
+	}
+	return record, int64(len(line)), nil
+}
+
+// advance marks the next length bytes of the outbox as relayed.
+func (t *OutboxTopic) advance(length int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.offset += length
+	return t.writeOffset()
+}
+
+// compact empties the write ahead file once every message in it was relayed.
+func (t *OutboxTopic) compact() error {
+	if t.size == 0 {
+		return nil
+	}
+
+	if err := t.file.Truncate(0); err != nil {
+		return err
+	}
+	t.size, t.offset = 0, 0
+	return t.writeOffset()
+}
+
+func (t *OutboxTopic) readOffset() (int64, error) {
+	content, err := os.ReadFile(t.offsetPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("natspubsub: outbox offset is corrupt : %w", err)
+	}
+	if offset > t.size {
+		offset = t.size
+	}
+	return offset, nil
+}
+
+// writeOffset replaces the offset file through a synced temporary file, so a crash leaves either the old or the new offset.
+func (t *OutboxTopic) writeOffset() error {
+	file, err := os.OpenFile(t.offsetTemp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(strconv.FormatInt(t.offset, 10))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err0 := file.Close(); err == nil {
+		err = err0
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(t.offsetTemp, t.offsetPath)
+}
+
+func (t *OutboxTopic) reportError(err error) {
+	if t.errorHandler != nil {
+		t.errorHandler(err)
+	}
+}
+
+// isUnreachableError reports whether a publish failed because the server could not be reached,
+// rather than because of the message itself.
+func isUnreachableError(err error) bool {
+	return isTransientPublishError(err) ||
+		errors.Is(err, nats.ErrConnectionClosed) ||
+		errors.Is(err, nats.ErrConnectionDraining) ||
+		errors.Is(err, nats.ErrConnectionReconnecting) ||
+		errors.Is(err, nats.ErrDisconnected) ||
+		errors.Is(err, nats.ErrReconnectBufExceeded)
+}
@@ -1,22 +1,34 @@
 package connections
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 	"gocloud.dev/pubsub/driver"
-	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// NewPlain creates a Connection publishing and subscribing over core nats.
+// It wraps the error handler of natsConn, calling the one set before, to tell which flushed publishes the server refused.
+// Refusals naming a subject fail the flushing batches publishing to it, other errors of the connection fail
+// every batch flushing at the time. An error handler set on natsConn afterwards replaces the wrapper,
+// flushes then only notice refusals through the last error of the connection and fail once their flush timeout passed.
 func NewPlain(natsConn *nats.Conn) Connection {
-	return &plainConnection{natsConnection: natsConn}
+	return &plainConnection{natsConnection: natsConn, publishErrors: watchPublishErrors(natsConn)}
 }
 
 type plainConnection struct {
 	// Connection to use for communication with the server.
 	natsConnection *nats.Conn
+	// publishErrors hands the errors the server reports asynchronously to the publishes waiting for them.
+	publishErrors *publishErrors
 }
 
 func (c *plainConnection) Raw() interface{} {
@@ -25,93 +37,510 @@ func (c *plainConnection) Raw() interface{} {
 
 func (c *plainConnection) CreateTopic(ctx context.Context, opts *TopicOptions) (Topic, error) {
 
-	return &plainNatsTopic{subject: opts.Subject, plainConn: c.natsConnection}, nil
+	if opts.ScheduleStream != "" {
+		return nil, ErrSchedulingNotSupported
+	}
+
+	ackTimeout := opts.AckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckWait
+	}
+
+	flushTimeout := opts.FlushTimeout
+	if flushTimeout <= 0 {
+		flushTimeout = defaultFlushTimeout
+	}
+
+	var topic Topic = &plainNatsTopic{
+		subject:        opts.Subject,
+		plainConn:      c.natsConnection,
+		acknowledged:   opts.Acknowledged,
+		ackTimeout:     ackTimeout,
+		maxAckAttempts: opts.MaxAckAttempts,
+		concurrency:    opts.PublishConcurrency,
+		flush:          opts.FlushOnSend,
+		flushTimeout:   flushTimeout,
+		publishErrors:  c.publishErrors,
+		headerCodec:    opts.HeaderCodec,
+	}
+
+	if opts.Outbox != nil {
+		return NewOutboxTopic(topic, c.natsConnection, *opts.Outbox)
+	}
+	return topic, nil
 }
 
 func (c *plainConnection) CreateSubscription(ctx context.Context, opts *SubscriptionOptions) (Queue, error) {
 
-	fmt.Println("---------------------------------------------------------------------------")
-	fmt.Printf(" subscribing to : [%s] {%s}", opts.SetupOpts.Subjects[0], opts.SetupOpts.DurableQueue)
-	fmt.Println("--------------------------------------------------------------------------")
-
 	sOpts := opts.SetupOpts
 
-	//We force the batch fetch size to 1, as only jetstream enabled connections can do batch fetches
-	// see: https://pkg.go.dev/github.com/nats-io/nats.go@v1.30.1#Conn.QueueSubscribeSync
-	opts.ConsumerMaxBatchSize = 1
+	subjects := sOpts.FilterSubjects
+	if len(subjects) == 0 {
+		subjects = sOpts.Subjects
+	}
+
+	if len(subjects) == 0 {
+		return nil, nats.ErrBadSubject
+	}
+
+	// Messages are delivered in the background and buffered until received in batches.
+	bufferSize := defaultMessageBufferSize
+	if opts.ConsumerMaxBatchSize > bufferSize {
+		bufferSize = opts.ConsumerMaxBatchSize
+	}
 
-	if sOpts.DurableQueue != "" {
+	queue := &natsConsumer{
+		natsConn:          c.natsConnection,
+		messages:          make(chan *nats.Msg, bufferSize),
+		closed:            make(chan struct{}),
+		acknowledged:      opts.Acknowledged,
+		batchFetchTimeout: time.Duration(opts.ConsumerMaxBatchTimeoutMs) * time.Millisecond,
+		batchMaxBytes:     opts.ConsumerMaxBatchBytesSize,
+		headerCodec:       opts.HeaderCodec,
+	}
 
-		subsc, err := c.natsConnection.QueueSubscribeSync(sOpts.Subjects[0], sOpts.DurableQueue)
+	// Every subject gets its own subscription, all of them feed into the one queue.
+	// Using nats without any form of queue mechanism is fine only where
+	// loosing some messages is ok as this essentially is an atmost once delivery situation here,
+	// unless the queue is acknowledged and the publisher keeps sending each message until it is acked.
+	for _, subject := range subjects {
+
+		var subsc *nats.Subscription
+		var err error
+		if sOpts.DurableQueue != "" {
+			subsc, err = c.natsConnection.QueueSubscribe(subject, sOpts.DurableQueue, queue.enqueue)
+		} else {
+			subsc, err = c.natsConnection.Subscribe(subject, queue.enqueue)
+		}
 		if err != nil {
+			_ = queue.Unsubscribe()
 			return nil, err
 		}
 
-		return &natsConsumer{consumer: subsc, durable: true,
-			batchFetchTimeout: time.Duration(opts.ConsumerMaxBatchTimeoutMs) * time.Millisecond}, nil
-	}
+		queue.consumers = append(queue.consumers, subsc)
 
-	// Using nats without any form of queue mechanism is fine only where
-	// loosing some messages is ok as this essentially is an atmost once delivery situation here.
-	subsc, err := c.natsConnection.SubscribeSync(sOpts.Subjects[0])
-	if err != nil {
-		return nil, err
+		if opts.ConsumerPendingMsgsLimit != 0 || opts.ConsumerPendingBytesLimit != 0 {
+			err = subsc.SetPendingLimits(pendingLimit(opts.ConsumerPendingMsgsLimit, nats.DefaultSubPendingMsgsLimit),
+				pendingLimit(opts.ConsumerPendingBytesLimit, nats.DefaultSubPendingBytesLimit))
+			if err != nil {
+				_ = queue.Unsubscribe()
+				return nil, err
+			}
+		}
 	}
 
-	return &natsConsumer{consumer: subsc, durable: false,
-		batchFetchTimeout: time.Duration(opts.ConsumerMaxBatchTimeoutMs) * time.Millisecond}, nil
+	return queue, nil
 
 }
 
+// pendingLimit falls back to the nats default when no limit is set, as zero is not a valid pending limit.
+func pendingLimit(limit, defaultLimit int) int {
+	if limit == 0 {
+		return defaultLimit
+	}
+	return limit
+}
+
+// Replies sent by acknowledged subscriptions, they match the acknowledgements of jetstream.
+var (
+	ackReply = []byte("+ACK")
+	nakReply = []byte("-NAK")
+)
+
+// ackRetryWait is the pause before publishing again when no subscriber is listening.
+const ackRetryWait = 100 * time.Millisecond
+
+// ErrFlushFailed is returned for messages the server did not confirm receiving.
+var ErrFlushFailed = errors.New("natspubsub: server did not confirm receiving the published messages")
+
+// defaultFlushTimeout is how long a flush waits for the server when no timeout is configured.
+const defaultFlushTimeout = 10 * time.Second
+
+// ErrNotAcknowledged is returned when an acknowledged publish runs out of attempts.
+var ErrNotAcknowledged = errors.New("natspubsub: message was not acknowledged by any subscriber")
+
 type plainNatsTopic struct {
 	subject   string
 	plainConn *nats.Conn
+
+	acknowledged   bool
+	ackTimeout     time.Duration
+	maxAckAttempts int
+	concurrency    int
+
+	// flush waits for the server to confirm it received each batch.
+	flush         bool
+	flushTimeout  time.Duration
+	publishErrors *publishErrors
+
+	// headerCodec decodes the headers of replies.
+	headerCodec HeaderCodec
 }
 
 func (t *plainNatsTopic) Subject() string {
 	return t.subject
 }
-func (t *plainNatsTopic) PublishMessage(_ context.Context, msg *nats.Msg) (string, error) {
-	var err error
-	if err = t.plainConn.PublishMsg(msg); err != nil {
-		return "", err
+
+// PublishMessage implements Topic.PublishMessage, core nats has no acknowledgement to return.
+func (t *plainNatsTopic) PublishMessage(ctx context.Context, msg *nats.Msg) (*jetstream.PubAck, error) {
+	if t.acknowledged {
+		return nil, t.publishAcknowledged(ctx, msg)
 	}
 
-	return "", nil
+	return nil, t.plainConn.PublishMsg(msg)
 }
 
+// Request implements Requester.Request.
+func (t *plainNatsTopic) Request(ctx context.Context, msg *nats.Msg, count int) ([]*driver.Message, error) {
+	return request(ctx, t.plainConn, t, msg, count, t.headerCodec)
+}
+
+// PublishMessages implements BatchPublisher.PublishMessages, with up to the publish concurrency sent at once.
+// When flushing, messages only count as published once the server confirmed receiving them.
+func (t *plainNatsTopic) PublishMessages(ctx context.Context, msgs []*nats.Msg) ([]*jetstream.PubAck, error) {
+	if !t.flush {
+		return publishConcurrently(ctx, t, msgs, t.concurrency)
+	}
+
+	watch := t.publishErrors.watch(msgs)
+	defer t.publishErrors.unwatch(watch)
+	lastErr := t.plainConn.LastError()
+
+	acks, err := publishConcurrently(ctx, t, msgs, t.concurrency)
+
+	var batchErr *PublishBatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return acks, err
+	}
+
+	flushErr := t.confirm(ctx, watch, lastErr)
+	if flushErr == nil {
+		return acks, err
+	}
+
+	// Without the confirmation none of the messages handed to the client is known to have arrived.
+	if batchErr == nil {
+		batchErr = &PublishBatchError{Failed: map[int]error{}}
+	}
+	for i := range msgs {
+		if batchErr.Failed[i] == nil {
+			batchErr.Failed[i] = flushErr
+		}
+	}
+	return acks, batchErr
+}
+
+// confirm flushes the connection and reports any publish error the server raised while watch was open.
+// Errors reach the error handler asynchronously, a change of the last connection error tells one is on its way.
+func (t *plainNatsTopic) confirm(ctx context.Context, watch *publishWatch, lastErr error) error {
+	flushCtx, cancel := context.WithTimeout(ctx, t.flushTimeout)
+	defer cancel()
+
+	if err := t.plainConn.FlushWithContext(flushCtx); err != nil {
+		return fmt.Errorf("%w : %v", ErrFlushFailed, err)
+	}
+
+	if t.plainConn.LastError() != lastErr && !watch.wait(flushCtx) {
+		return fmt.Errorf("%w : %v", ErrFlushFailed, t.plainConn.LastError())
+	}
+
+	if err := watch.err(); err != nil {
+		return fmt.Errorf("%w : %v", ErrFlushFailed, err)
+	}
+	return nil
+}
+
+// publishErrors passes the errors the connection reports asynchronously to every publish watching for them.
+type publishErrors struct {
+	mutex   sync.Mutex
+	watches map[*publishWatch]struct{}
+}
+
+// publishWatch collects the asynchronous errors of the connection while a publish waits for its confirmation.
+// Only errors without a subscription, such as refused publishes, concern the publish,
+// and of the refusals only those naming one of its subjects.
+type publishWatch struct {
+	subjects map[string]bool
+
+	mutex    sync.Mutex
+	reported bool
+	errs     []error
+	notify   chan struct{}
+}
+
+// watchPublishErrors installs an error handler on natsConn that feeds the returned publishErrors,
+// the handler set before keeps being called.
+func watchPublishErrors(natsConn *nats.Conn) *publishErrors {
+	pe := &publishErrors{watches: map[*publishWatch]struct{}{}}
+
+	previous := natsConn.ErrorHandler()
+	natsConn.SetErrorHandler(func(conn *nats.Conn, sub *nats.Subscription, err error) {
+		pe.report(sub, err)
+		if previous != nil {
+			previous(conn, sub, err)
+		}
+	})
+	return pe
+}
+
+// watch starts collecting the errors concerning the publish of msgs.
+func (pe *publishErrors) watch(msgs []*nats.Msg) *publishWatch {
+	subjects := map[string]bool{}
+	for _, msg := range msgs {
+		subjects[msg.Subject] = true
+		if msg.Reply != "" {
+			subjects[msg.Reply] = true
+		}
+	}
+
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	watch := &publishWatch{subjects: subjects, notify: make(chan struct{}, 1)}
+	pe.watches[watch] = struct{}{}
+	return watch
+}
+
+func (pe *publishErrors) unwatch(watch *publishWatch) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	delete(pe.watches, watch)
+}
+
+func (pe *publishErrors) report(sub *nats.Subscription, err error) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	for watch := range pe.watches {
+		watch.report(sub, err)
+	}
+}
+
+func (w *publishWatch) report(sub *nats.Subscription, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.reported = true
+	if sub == nil && w.concerns(err) {
+		w.errs = append(w.errs, err)
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// concerns reports whether err may have been caused by the watched publish,
+// that is unless it is a refusal of another subject.
+func (w *publishWatch) concerns(err error) bool {
+	subject, ok := refusedSubject(err)
+	return !ok || w.subjects[subject]
+}
+
+// refusedSubject returns the subject named by a permissions violation, reporting false for other errors.
+func refusedSubject(err error) (string, bool) {
+	text := err.Error()
+	if !strings.Contains(strings.ToLower(text), nats.PERMISSIONS_ERR) {
+		return "", false
+	}
+
+	start := strings.Index(text, `"`)
+	if start < 0 {
+		return "", false
+	}
+	subject, err := strconv.Unquote(text[start:])
+	if err != nil {
+		return "", false
+	}
+	return subject, true
+}
+
+// wait blocks until an error was reported or ctx is done, reporting false in the latter case.
+func (w *publishWatch) wait(ctx context.Context) bool {
+	for {
+		w.mutex.Lock()
+		reported := w.reported
+		w.mutex.Unlock()
+		if reported {
+			return true
+		}
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// err returns the first publish error reported.
+func (w *publishWatch) err() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.errs) == 0 {
+		return nil
+	}
+	return w.errs[0]
+}
+
+// publishAcknowledged sends msg as a request and publishes it again until a subscriber acknowledges it,
+// every attempt waits for the reply up to the ack timeout.
+func (t *plainNatsTopic) publishAcknowledged(ctx context.Context, msg *nats.Msg) error {
+	var lastErr error
+	for attempt := 1; t.maxAckAttempts <= 0 || attempt <= t.maxAckAttempts; attempt++ {
+
+		attemptCtx, cancel := context.WithTimeout(ctx, t.ackTimeout)
+		reply, err := t.plainConn.RequestMsgWithContext(attemptCtx, msg)
+		cancel()
+
+		switch {
+		case err == nil && bytes.Equal(reply.Data, ackReply):
+			return nil
+		case err == nil:
+			lastErr = fmt.Errorf("negatively acknowledged with %q", reply.Data)
+		default:
+			lastErr = err
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		// Without any subscriber the request fails right away, so wait a little before trying again.
+		if errors.Is(err, nats.ErrNoResponders) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(ackRetryWait):
+			}
+		}
+	}
+
+	return fmt.Errorf("%w after %d attempts : %v", ErrNotAcknowledged, t.maxAckAttempts, lastErr)
+}
+
+// ErrNackNotSupported is returned when negatively acknowledging messages received over core nats.
+var ErrNackNotSupported = errors.New("natspubsub: core nats can not redeliver negatively acknowledged messages")
+
+// defaultMessageBufferSize is the number of messages held for a plain queue between receives.
+const defaultMessageBufferSize = 1000
+
+// maxReceiveWait is the longest a receive waits for the first message when nothing is buffered.
+const maxReceiveWait = time.Second
+
 type natsConsumer struct {
-	consumer          *nats.Subscription
-	durable           bool
+	natsConn  *nats.Conn
+	consumers []*nats.Subscription
+	messages  chan *nats.Msg
+	closed    chan struct{}
+	closeOnce sync.Once
+	// acknowledged queues answer the reply subject of messages, so that the publisher can redeliver them.
+	acknowledged      bool
+	skipped           atomic.Uint64
 	batchFetchTimeout time.Duration
+	// batchMaxBytes caps the payload bytes handed out by a single receive, zero means no cap.
+	batchMaxBytes int
+	headerCodec   HeaderCodec
+
+	// held keeps messages that did not fit into the byte cap of a previous receive.
+	heldMutex sync.Mutex
+	held      []*nats.Msg
+}
+
+// enqueue is the message handler shared by all the subscriptions of the queue.
+func (q *natsConsumer) enqueue(msg *nats.Msg) {
+	select {
+	case q.messages <- msg:
+	case <-q.closed:
+	}
 }
 
+func (q *natsConsumer) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsDurable only holds for acknowledged queues, otherwise core nats delivers messages at most once.
 func (q *natsConsumer) IsDurable() bool {
-	return q.durable
+	return q.acknowledged
 }
 
 func (q *natsConsumer) Unsubscribe() error {
-	return q.consumer.Unsubscribe()
+	q.closeOnce.Do(func() { close(q.closed) })
+
+	var errs []error
+	for _, consumer := range q.consumers {
+		if err := consumer.Unsubscribe(); err != nil && !errors.Is(err, nats.ErrBadSubscription) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// Dropped implements DroppedCounter.Dropped, adding up the drops of all subscriptions feeding the queue.
+func (q *natsConsumer) Dropped() (int, error) {
+	total := 0
+	for _, consumer := range q.consumers {
+		dropped, err := consumer.Dropped()
+		if err != nil {
+			return total, err
+		}
+		total += dropped
+	}
+	return total, nil
+}
+
+// ReceiveMessages returns the messages already buffered right away,
+// when the buffer is empty it waits up to about a second for the first message to arrive.
 func (q *natsConsumer) ReceiveMessages(ctx context.Context, batchSize int) ([]*driver.Message, error) {
 
 	var messages []*driver.Message
+	batchBytes := 0
 
-	for i := 0; i < batchSize; i++ {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
 
-		msg, err := q.consumer.NextMsg(q.batchFetchTimeout)
-		if err != nil {
-			fmt.Printf(" error occurred : [%s] ", err)
-			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
-				return messages, nil
+	wait := maxReceiveWait
+	if q.batchFetchTimeout > 0 && q.batchFetchTimeout < wait {
+		wait = q.batchFetchTimeout
+	}
+
+	for len(messages) < batchSize {
+
+		msg := q.takeHeld()
+		if msg == nil {
+			var err error
+			msg, err = q.nextMessage(ctx, len(messages) == 0, wait)
+			if err != nil {
+				return nil, err
 			}
-			return nil, err
 		}
-		driverMsg, err := decodeMessage(msg)
+		if msg == nil {
+			if len(messages) == 0 && q.isClosed() {
+				return nil, nats.ErrBadSubscription
+			}
+			return messages, nil
+		}
+
+		// The first message is always handed out, even when it is bigger than the cap on its own.
+		size := messageSize(msg)
+		if q.batchMaxBytes > 0 && len(messages) > 0 && batchBytes+size > q.batchMaxBytes {
+			q.hold(msg)
+			return messages, nil
+		}
+		batchBytes += size
+
+		driverMsg, err := decodeMessage(msg, q.responder(msg), q.headerCodec)
 
 		if err != nil {
-			fmt.Printf(" error decoding : [%s] ", err)
 			return nil, err
 		}
 
@@ -122,69 +551,170 @@ func (q *natsConsumer) ReceiveMessages(ctx context.Context, batchSize int) ([]*d
 
 }
 
-func (q *natsConsumer) Ack(ctx context.Context, ids []driver.AckID) error {
+// nextMessage takes a message from the buffer, waiting for one only when block is set.
+// It returns no message when none is available or the queue is closed, and the context error once ctx is done.
+func (q *natsConsumer) nextMessage(ctx context.Context, block bool, wait time.Duration) (*nats.Msg, error) {
+
+	if !block {
+		select {
+		case msg := <-q.messages:
+			return msg, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case msg := <-q.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-q.closed:
+		return nil, nil
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+func (q *natsConsumer) takeHeld() *nats.Msg {
+	q.heldMutex.Lock()
+	defer q.heldMutex.Unlock()
+
+	if len(q.held) == 0 {
+		return nil
+	}
+
+	msg := q.held[0]
+	q.held = q.held[1:]
+	return msg
+}
+
+func (q *natsConsumer) hold(msg *nats.Msg) {
+	q.heldMutex.Lock()
+	defer q.heldMutex.Unlock()
+
+	q.held = append(q.held, msg)
+}
+
+// messageSize approximates the bytes a message occupies, counting its payload and headers.
+func messageSize(msg *nats.Msg) int {
+	size := len(msg.Data)
+	for k, values := range msg.Header {
+		for _, v := range values {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// responder answers requests received on the queue. The reply subject of messages on acknowledged queues
+// is reserved for acknowledgements, so only requests naming their reply subject in a header can be answered.
+func (q *natsConsumer) responder(msg *nats.Msg) Responder {
+	reply := msg.Reply
+	if q.acknowledged {
+		reply = ""
+	}
+	return newResponder(q.natsConn, msg.Header, reply)
+}
+
+// Skipped implements SkippedCounter.Skipped.
+func (q *natsConsumer) Skipped() uint64 {
+	return q.skipped.Load()
+}
+
+// ackMessages picks the nats messages out of ids, counting any id of another type as skipped.
+func (q *natsConsumer) ackMessages(ids []driver.AckID) []*nats.Msg {
+	msgs := make([]*nats.Msg, 0, len(ids))
 	for _, id := range ids {
 		msg, ok := id.(*nats.Msg)
 		if !ok {
+			q.skipped.Add(1)
 			continue
 		}
-		_ = msg.Ack()
+		msgs = append(msgs, msg)
 	}
+	return msgs
+}
 
-	return nil
+// Ack confirms the messages to their publishers on acknowledged queues.
+// Otherwise there is nothing to confirm, core nats delivers messages at most once and keeps no acknowledgement state.
+func (q *natsConsumer) Ack(ctx context.Context, ids []driver.AckID) error {
+	msgs := q.ackMessages(ids)
+	if !q.acknowledged {
+		return nil
+	}
+
+	var errs []error
+	for _, msg := range msgs {
+		if msg.Reply == "" {
+			continue
+		}
+		errs = append(errs, msg.Respond(ackReply))
+	}
+	return errors.Join(errs...)
 }
 
+// Nack asks the publishers of the messages to send them again on acknowledged queues.
+// Otherwise it reports that the messages can not be redelivered, as core nats has no way of doing so.
 func (q *natsConsumer) Nack(ctx context.Context, ids []driver.AckID) error {
-	for _, id := range ids {
-		msg, ok := id.(*nats.Msg)
-		if !ok {
+	var errs []error
+	notRedelivered := 0
+	for _, msg := range q.ackMessages(ids) {
+		if !q.acknowledged || msg.Reply == "" {
+			notRedelivered++
 			continue
 		}
-		_ = msg.Nak()
+		errs = append(errs, msg.Respond(nakReply))
 	}
 
-	return nil
+	if notRedelivered > 0 {
+		errs = append(errs, fmt.Errorf("%w : %d messages not redelivered", ErrNackNotSupported, notRedelivered))
+	}
+	return errors.Join(errs...)
 }
 
-func messageAsFunc(msg *nats.Msg) func(interface{}) bool {
+func messageAsFunc(msg *nats.Msg, responder Responder, codec HeaderCodec) func(interface{}) bool {
 	return func(i any) bool {
-		p, ok := i.(**nats.Msg)
-		if !ok {
-			return false
+		switch p := i.(type) {
+		case **nats.Msg:
+			*p = msg
+			return true
+		case *nats.Header:
+			*p = msg.Header
+			return true
+		case *HeaderCodec:
+			*p = headerCodecOrDefault(codec)
+			return true
+		case *Responder:
+			if responder == nil {
+				return false
+			}
+			*p = responder
+			return true
 		}
-		*p = msg
-		return true
+		return false
 	}
 }
 
-func decodeMessage(msg *nats.Msg) (*driver.Message, error) {
+// decodeMessage converts msg into a driver message using codec, responder is exposed through As when it is not nil.
+func decodeMessage(msg *nats.Msg, responder Responder, codec HeaderCodec) (*driver.Message, error) {
 	if msg == nil {
 		return nil, nats.ErrInvalidMsg
 	}
 
 	dm := driver.Message{
-		AsFunc: messageAsFunc(msg),
+		AsFunc: messageAsFunc(msg, responder, codec),
 		Body:   msg.Data,
 	}
 
-	if msg.Header != nil {
-		dm.Metadata = map[string]string{}
-		for k, v := range msg.Header {
-			var sv string
-			if len(v) > 0 {
-				sv = v[0]
-			}
-			kb, err := url.QueryUnescape(k)
-			if err != nil {
-				return nil, err
-			}
-			vb, err := url.QueryUnescape(sv)
-			if err != nil {
-				return nil, err
-			}
-			dm.Metadata[kb] = vb
-		}
+	metadata, err := DecodeHeader(msg.Header, codec)
+	if err != nil {
+		return nil, err
 	}
+	dm.Metadata = metadata
 
 	dm.AckID = msg
 
@@ -0,0 +1,118 @@
+package connections
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// rawHeaders are read by the jetstream server or by this package, so they are published and received as is
+// instead of passing through the header codec.
+var rawHeaders = map[string]bool{
+	jetstream.MsgIDHeader:               true,
+	jetstream.ExpectedStreamHeader:      true,
+	jetstream.ExpectedLastSeqHeader:     true,
+	jetstream.ExpectedLastSubjSeqHeader: true,
+	jetstream.ExpectedLastMsgIDHeader:   true,
+
+	HeaderReplyTo:              true,
+	HeaderScheduleTarget:       true,
+	HeaderScheduleDeliverAt:    true,
+	HeaderDeadLetterStream:     true,
+	HeaderDeadLetterSequence:   true,
+	HeaderDeadLetterSubject:    true,
+	HeaderDeadLetterDeliveries: true,
+	HeaderDeadLetterLastError:  true,
+}
+
+// IsRawHeader reports whether the header key is interpreted by the server or this package and must not be encoded.
+func IsRawHeader(key string) bool {
+	return rawHeaders[key]
+}
+
+// BatchPublisher is implemented by topics that publish a whole batch of messages at once.
+type BatchPublisher interface {
+	// PublishMessages publishes msgs and returns the acknowledgement of each one in the same order,
+	// messages that could not be published are reported through a *PublishBatchError.
+	PublishMessages(ctx context.Context, msgs []*nats.Msg) ([]*jetstream.PubAck, error)
+}
+
+// PublishBatchError reports the messages of a batch that could not be published.
+type PublishBatchError struct {
+	// Failed maps the position of every failed message in the batch to the reason it failed.
+	Failed map[int]error
+}
+
+func (e *PublishBatchError) Error() string {
+	positions := e.positions()
+
+	reasons := make([]string, 0, len(positions))
+	for _, position := range positions {
+		reasons = append(reasons, fmt.Sprintf("[%d] %v", position, e.Failed[position]))
+	}
+
+	return fmt.Sprintf("natspubsub: %d messages failed to publish : %s", len(positions), strings.Join(reasons, ", "))
+}
+
+func (e *PublishBatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, position := range e.positions() {
+		errs = append(errs, e.Failed[position])
+	}
+	return errs
+}
+
+func (e *PublishBatchError) positions() []int {
+	positions := make([]int, 0, len(e.Failed))
+	for position := range e.Failed {
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// publishConcurrently publishes msgs through topic with up to concurrency messages in flight at once,
+// one at a time when concurrency is below 2. Failures are reported by position in a *PublishBatchError.
+func publishConcurrently(ctx context.Context, topic Topic, msgs []*nats.Msg, concurrency int) ([]*jetstream.PubAck, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	acks := make([]*jetstream.PubAck, len(msgs))
+	errs := make([]error, len(msgs))
+
+	window := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, msg := range msgs {
+		window <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-window
+			errs[i] = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, msg *nats.Msg) {
+			defer wg.Done()
+			defer func() { <-window }()
+			acks[i], errs[i] = topic.PublishMessage(ctx, msg)
+		}(i, msg)
+	}
+	wg.Wait()
+
+	failed := map[int]error{}
+	for i, err := range errs {
+		if err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return acks, &PublishBatchError{Failed: failed}
+	}
+	return acks, nil
+}
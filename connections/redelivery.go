@@ -0,0 +1,87 @@
+package connections
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RedeliveryPolicy decides how long a negatively acknowledged message waits before it is redelivered.
+// Delaying redelivery avoids hot retry loops on messages whose downstream dependency is unavailable.
+type RedeliveryPolicy interface {
+	// Delay returns the wait before the next delivery of a message already delivered numDelivered times.
+	Delay(numDelivered uint64) time.Duration
+}
+
+// FixedRedeliveryPolicy waits the same amount of time before every redelivery.
+type FixedRedeliveryPolicy struct {
+	Interval time.Duration
+}
+
+func (p FixedRedeliveryPolicy) Delay(_ uint64) time.Duration {
+	return p.Interval
+}
+
+// ExponentialRedeliveryPolicy grows the wait by Multiplier on every delivery, starting at Initial and capped at Max.
+// Jitter is the fraction, between 0 and 1, by which the wait is randomly shortened or lengthened.
+type ExponentialRedeliveryPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func (p ExponentialRedeliveryPolicy) Delay(numDelivered uint64) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	attempt := float64(0)
+	if numDelivered > 1 {
+		attempt = float64(numDelivered - 1)
+	}
+
+	if p.Initial <= 0 {
+		return 0
+	}
+
+	// Without a Max the wait outgrows a time.Duration after enough deliveries, it is held at the longest one instead.
+	limit := float64(math.MaxInt64)
+	if p.Max > 0 {
+		limit = float64(p.Max)
+	}
+
+	delay := float64(p.Initial) * math.Pow(multiplier, attempt)
+	if delay > limit {
+		delay = limit
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// TableRedeliveryPolicy picks the wait for each delivery attempt from Delays,
+// the last entry is reused once the deliveries outnumber the table.
+type TableRedeliveryPolicy struct {
+	Delays []time.Duration
+}
+
+func (p TableRedeliveryPolicy) Delay(numDelivered uint64) time.Duration {
+	if len(p.Delays) == 0 {
+		return 0
+	}
+
+	index := len(p.Delays) - 1
+	if numDelivered > 0 && numDelivered <= uint64(len(p.Delays)) {
+		index = int(numDelivered - 1)
+	}
+
+	return p.Delays[index]
+}
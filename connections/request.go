@@ -0,0 +1,97 @@
+package connections
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"gocloud.dev/pubsub/driver"
+)
+
+// HeaderReplyTo carries the subject a requester waits for replies on.
+// Unlike the reply subject of a message, headers are kept when the request is stored in a stream.
+// Only Request sets it, metadata can not carry it and received messages do not show it in their metadata.
+const HeaderReplyTo = "Request-Reply-To"
+
+// ErrRequestNotSupported is returned when the connection of a topic can not receive replies.
+var ErrRequestNotSupported = errors.New("natspubsub: topic connection can not receive replies")
+
+// Requester is implemented by topics able to collect the replies to the messages they publish.
+type Requester interface {
+	// Request publishes msg and returns the replies received until count of them arrived or ctx is done,
+	// a count below one collects replies until ctx is done. The context error is only returned when no reply arrived.
+	Request(ctx context.Context, msg *nats.Msg, count int) ([]*driver.Message, error)
+}
+
+// Responder is exposed through the As function of received messages that were sent as requests.
+type Responder interface {
+	// Respond publishes reply to the subject the requester waits for replies on.
+	Respond(reply *nats.Msg) error
+}
+
+// request publishes msg through topic and gathers the replies on a fresh inbox of natsConn, decoding them with codec.
+func request(ctx context.Context, natsConn *nats.Conn, topic Topic, msg *nats.Msg, count int, codec HeaderCodec) ([]*driver.Message, error) {
+	if natsConn == nil {
+		return nil, ErrRequestNotSupported
+	}
+
+	inbox := natsConn.NewInbox()
+	sub, err := natsConn.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(HeaderReplyTo, inbox)
+	msg.Reply = inbox
+
+	if _, err = topic.PublishMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	var replies []*driver.Message
+	for count < 1 || len(replies) < count {
+		reply, err0 := sub.NextMsgWithContext(ctx)
+		if err0 != nil {
+			if len(replies) > 0 && ctx.Err() != nil {
+				return replies, nil
+			}
+			return replies, err0
+		}
+
+		dm, err0 := decodeMessage(reply, nil, codec)
+		if err0 != nil {
+			return replies, err0
+		}
+		replies = append(replies, dm)
+	}
+
+	return replies, nil
+}
+
+// replyResponder publishes replies to the subject taken from a received request.
+type replyResponder struct {
+	natsConn *nats.Conn
+	subject  string
+}
+
+// newResponder returns a Responder for a message received with the given headers and reply subject,
+// or nil when the message can not be replied to.
+func newResponder(natsConn *nats.Conn, header nats.Header, reply string) Responder {
+	subject := header.Get(HeaderReplyTo)
+	if subject == "" {
+		subject = reply
+	}
+
+	if natsConn == nil || subject == "" {
+		return nil
+	}
+	return replyResponder{natsConn: natsConn, subject: subject}
+}
+
+func (r replyResponder) Respond(reply *nats.Msg) error {
+	reply.Subject = r.subject
+	return r.natsConn.PublishMsg(reply)
+}
@@ -0,0 +1,99 @@
+package connections
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nuid"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultPublishRetryBackoff = 100 * time.Millisecond
+	defaultPublishRetryTimeout = 5 * time.Second
+)
+
+// PublishRetryPolicy retries jetstream publishes that fail while the stream is briefly unavailable,
+// e.g. during a stream leader election or a server restart. Messages without a Nats-Msg-Id are given one,
+// so that a retry of a publish the stream did store after all is dropped as a duplicate.
+type PublishRetryPolicy struct {
+	// Attempts is how many times a message is published at most, below two failed publishes are not retried.
+	Attempts int
+	// InitialBackoff is the wait before the first retry, defaults to 100ms. It doubles on every further retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction, between 0 and 1, by which each wait is randomly shortened or lengthened.
+	Jitter float64
+	// AttemptTimeout bounds the wait for the acknowledgement of each attempt, defaults to 5s.
+	AttemptTimeout time.Duration
+}
+
+// publishWithRetry publishes msg, retrying transient failures as set by policy until ctx is done.
+// No retry is started when its backoff would outlast the deadline of ctx.
+func publishWithRetry(ctx context.Context, js jetstream.JetStream, msg *nats.Msg, policy PublishRetryPolicy) (*jetstream.PubAck, error) {
+	setMsgID(msg)
+
+	backoff := ExponentialRedeliveryPolicy{
+		Initial: policy.InitialBackoff,
+		Max:     policy.MaxBackoff,
+		Jitter:  policy.Jitter,
+	}
+	if backoff.Initial <= 0 {
+		backoff.Initial = defaultPublishRetryBackoff
+	}
+
+	attemptTimeout := policy.AttemptTimeout
+	if attemptTimeout <= 0 {
+		attemptTimeout = defaultPublishRetryTimeout
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		ack, err := js.PublishMsg(attemptCtx, msg)
+		cancel()
+		if err == nil {
+			return ack, nil
+		}
+
+		if attempt >= policy.Attempts || ctx.Err() != nil || !isTransientPublishError(err) {
+			return nil, err
+		}
+
+		wait := backoff.Delay(uint64(attempt))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// setMsgID gives msg a Nats-Msg-Id unless it has one, so that jetstream drops any retry of it as a duplicate.
+func setMsgID(msg *nats.Msg) {
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	if msg.Header.Get(jetstream.MsgIDHeader) == "" {
+		msg.Header.Set(jetstream.MsgIDHeader, nuid.Next())
+	}
+}
+
+// isTransientPublishError reports whether a publish failed because the stream could not be reached for the moment.
+// Errors such as failed expectations are returned to the caller at once.
+func isTransientPublishError(err error) bool {
+	if errors.Is(err, jetstream.ErrNoStreamResponse) ||
+		errors.Is(err, nats.ErrNoResponders) ||
+		errors.Is(err, nats.ErrTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusServiceUnavailable
+}
@@ -0,0 +1,384 @@
+package connections
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"sync"
+	"time"
+)
+
+// MetadataDeliverAt holds the RFC 3339 time a message is due, messages carrying it are held back in
+// the schedule stream of the topic until a Scheduler delivers them to their subject.
+const MetadataDeliverAt = "deliver-at"
+
+// Headers of messages held in a schedule stream, carrying the subject and RFC 3339 time they are delivered at.
+const (
+	HeaderScheduleTarget    = "Schedule-Target"
+	HeaderScheduleDeliverAt = "Schedule-Deliver-At"
+)
+
+// schedulerConsumerName is the durable consumer the leading scheduler reads the schedule stream with.
+const schedulerConsumerName = "scheduler"
+
+// schedulerLeaderKey is the key of the lock bucket held by the leading scheduler.
+const schedulerLeaderKey = "leader"
+
+const (
+	defaultSchedulerLockTTL      = 10 * time.Second
+	defaultSchedulerPollInterval = time.Second
+	defaultSchedulerBatchSize    = 100
+)
+
+// ErrSchedulingNotSupported is returned when scheduling messages on a connection that can not store them.
+var ErrSchedulingNotSupported = errors.New("natspubsub: scheduled delivery requires a jetstream connection")
+
+// ErrInvalidDeliverAt is returned when the deliver-at metadata of a message is not an RFC 3339 time.
+var ErrInvalidDeliverAt = errors.New("natspubsub: deliver-at metadata is not an RFC 3339 time")
+
+// Clock tells the time a Scheduler compares due times against, tests can replace it with a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SchedulerOptions sets options for constructing a Scheduler.
+type SchedulerOptions struct {
+	// Stream is the schedule stream to deliver messages from, the ScheduleStream of the topics publishing them.
+	Stream string
+	// LockBucket names the key value bucket used to elect the leading scheduler, defaults to <Stream>_lock.
+	LockBucket string
+	// LockTTL is how long leadership lasts without being renewed, defaults to 10s. It must exceed PollInterval.
+	LockTTL time.Duration
+	// PollInterval is how often Run checks for due messages and renews leadership, defaults to 1s.
+	PollInterval time.Duration
+	// BatchSize is how many scheduled messages are looked at per poll, defaults to 100.
+	BatchSize int
+	// Name identifies the scheduler in the lock bucket, defaults to a fresh inbox like name.
+	Name string
+	// Clock decides when messages are due, defaults to the system clock.
+	Clock Clock
+	// ErrorHandler is given the errors of the polls made by Run, they are dropped when it is nil.
+	ErrorHandler func(error)
+}
+
+// Scheduler delivers the messages held in a schedule stream to their subject once they are due.
+// Any number of schedulers can run against the same stream, only the one holding the lock delivers messages.
+type Scheduler struct {
+	lock   jetstream.KeyValue
+	queue  Queue
+	target Topic
+
+	name         string
+	clock        Clock
+	pollInterval time.Duration
+	batchSize    int
+	errorHandler func(error)
+
+	// revision of the leader key while this scheduler holds it, zero otherwise.
+	leaderMutex sync.Mutex
+	revision    uint64
+}
+
+// NewScheduler creates a Scheduler for the schedule stream named in opts, creating the stream and lock bucket when missing.
+func NewScheduler(ctx context.Context, conn Connection, opts SchedulerOptions) (*Scheduler, error) {
+	jc, ok := conn.(*jetstreamConnection)
+	if !ok {
+		return nil, ErrSchedulingNotSupported
+	}
+
+	s := &Scheduler{
+		name:         opts.Name,
+		clock:        opts.Clock,
+		pollInterval: opts.PollInterval,
+		batchSize:    opts.BatchSize,
+		errorHandler: opts.ErrorHandler,
+	}
+	if s.name == "" {
+		s.name = nats.NewInbox()
+	}
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
+	if s.pollInterval <= 0 {
+		s.pollInterval = defaultSchedulerPollInterval
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultSchedulerBatchSize
+	}
+
+	lockTTL := opts.LockTTL
+	if lockTTL <= 0 {
+		lockTTL = defaultSchedulerLockTTL
+	}
+	lockBucket := opts.LockBucket
+	if lockBucket == "" {
+		lockBucket = fmt.Sprintf("%s_lock", opts.Stream)
+	}
+
+	var err error
+	s.lock, err = jc.jetStream.KeyValue(ctx, lockBucket)
+	if errors.Is(err, jetstream.ErrBucketNotFound) {
+		s.lock, err = jc.jetStream.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: lockBucket, TTL: lockTTL})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ensureScheduleStream(ctx, jc.jetStream, opts.Stream); err != nil {
+		return nil, err
+	}
+
+	// The scheduler reads only its own raw headers, the metadata is copied over untouched whatever the codec of the publisher.
+	s.queue, err = conn.CreateSubscription(ctx, &SubscriptionOptions{
+		ConsumerMaxBatchTimeoutMs: int(s.pollInterval / time.Millisecond),
+		HeaderCodec:               RawHeaderCodec{},
+		SetupOpts: &SetupOptions{
+			StreamName:   opts.Stream,
+			Subjects:     []string{scheduleSubject(opts.Stream, ">")},
+			DurableQueue: schedulerConsumerName,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Due messages are delivered through a topic without a schedule stream, so they are never scheduled again.
+	s.target, err = conn.CreateTopic(ctx, &TopicOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// IsLeader reports whether this scheduler held the lock at its last poll.
+func (s *Scheduler) IsLeader() bool {
+	s.leaderMutex.Lock()
+	defer s.leaderMutex.Unlock()
+	return s.revision != 0
+}
+
+// Run polls for due messages until ctx is done, then gives up leadership so another scheduler can take over at once.
+// Errors of the polls are given to the ErrorHandler of the scheduler.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Tick(ctx); err != nil && ctx.Err() == nil && s.errorHandler != nil {
+			s.errorHandler(fmt.Errorf("natspubsub: scheduler %s failed to deliver scheduled messages : %w", s.name, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return s.Close()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick campaigns for leadership and, when leading, delivers the messages that are due.
+// Messages not yet due are handed back to the schedule stream until their due time, messages that can not be
+// scheduled are dropped and reported in the returned error. It returns how many messages were delivered.
+func (s *Scheduler) Tick(ctx context.Context) (int, error) {
+	leader, err := s.campaign(ctx)
+	if err != nil || !leader {
+		return 0, err
+	}
+
+	dms, err := s.queue.ReceiveMessages(ctx, s.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var errs []error
+	for _, dm := range dms {
+		msg, ok := dm.AckID.(jetstream.Msg)
+		if !ok {
+			continue
+		}
+
+		due, target, err0 := scheduledDelivery(msg.Headers())
+		if err0 != nil {
+			errs = append(errs, fmt.Errorf("natspubsub: scheduler %s dropped message : %w", s.name, err0), msg.Term())
+			continue
+		}
+
+		if wait := due.Sub(s.clock.Now()); wait > 0 {
+			errs = append(errs, msg.NakWithDelay(wait))
+			continue
+		}
+
+		dm, err0 := dueMessage(msg, target)
+		if err0 != nil {
+			errs = append(errs, err0, msg.Nak())
+			continue
+		}
+
+		if _, err0 = s.target.PublishMessage(ctx, dm); err0 != nil {
+			errs = append(errs, err0, msg.Nak())
+			continue
+		}
+
+		if err0 = msg.DoubleAck(ctx); err0 != nil {
+			errs = append(errs, err0)
+			continue
+		}
+		delivered++
+	}
+
+	return delivered, errors.Join(errs...)
+}
+
+// Close gives up leadership and stops reading the schedule stream.
+func (s *Scheduler) Close() error {
+	s.leaderMutex.Lock()
+	revision := s.revision
+	s.revision = 0
+	s.leaderMutex.Unlock()
+
+	var err error
+	if revision != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.pollInterval)
+		defer cancel()
+		err = s.lock.Delete(ctx, schedulerLeaderKey, jetstream.LastRevision(revision))
+	}
+
+	return errors.Join(err, s.queue.Unsubscribe())
+}
+
+// campaign renews the lock when this scheduler holds it, or takes it when nobody does.
+func (s *Scheduler) campaign(ctx context.Context) (bool, error) {
+	s.leaderMutex.Lock()
+	defer s.leaderMutex.Unlock()
+
+	if s.revision != 0 {
+		revision, err := s.lock.Update(ctx, schedulerLeaderKey, []byte(s.name), s.revision)
+		if err == nil {
+			s.revision = revision
+			return true, nil
+		}
+		// The lock expired and may have been taken by another scheduler meanwhile.
+		s.revision = 0
+	}
+
+	revision, err := s.lock.Create(ctx, schedulerLeaderKey, []byte(s.name))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	s.revision = revision
+	return true, nil
+}
+
+// scheduleSubject is the subject of the schedule stream a message for target is held on.
+func scheduleSubject(stream string, target string) string {
+	return fmt.Sprintf("%s.%s", stream, target)
+}
+
+// ensureScheduleStream creates the work queue stream holding scheduled messages unless it exists already.
+func ensureScheduleStream(ctx context.Context, js jetstream.JetStream, stream string) error {
+	_, err := js.Stream(ctx, stream)
+	if err == nil || !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{scheduleSubject(stream, ">")},
+		Retention: jetstream.WorkQueuePolicy,
+	})
+	return err
+}
+
+// scheduleMessage moves msg to the schedule stream when it carries a due time,
+// messages already moved or without a due time are left untouched. The deliver-at metadata
+// is decoded with codec and replaced by the raw due time the Scheduler reads.
+func scheduleMessage(stream string, msg *nats.Msg, codec HeaderCodec) error {
+	if stream == "" || msg.Header == nil || msg.Header.Get(HeaderScheduleTarget) != "" {
+		return nil
+	}
+
+	key, err := headerCodecOrDefault(codec).EncodeKey(MetadataDeliverAt)
+	if err != nil {
+		return err
+	}
+	values := msg.Header[key]
+	if len(values) == 0 || values[0] == "" {
+		return nil
+	}
+
+	value, err := headerCodecOrDefault(codec).DecodeValue(values[0])
+	if err != nil {
+		return fmt.Errorf("%w : %v", ErrInvalidDeliverAt, err)
+	}
+	due, err := parseDeliverAt(value)
+	if err != nil {
+		return err
+	}
+
+	delete(msg.Header, key)
+	msg.Header.Set(HeaderScheduleDeliverAt, due.Format(time.RFC3339Nano))
+	msg.Header.Set(HeaderScheduleTarget, msg.Subject)
+	msg.Subject = scheduleSubject(stream, msg.Subject)
+	return nil
+}
+
+func parseDeliverAt(value string) (time.Time, error) {
+	due, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w : %v", ErrInvalidDeliverAt, err)
+	}
+	return due, nil
+}
+
+// scheduledDelivery reads the due time and target subject from the headers of a scheduled message.
+func scheduledDelivery(header nats.Header) (time.Time, string, error) {
+	due, err := parseDeliverAt(header.Get(HeaderScheduleDeliverAt))
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	target := header.Get(HeaderScheduleTarget)
+	if target == "" {
+		return time.Time{}, "", fmt.Errorf("natspubsub: scheduled message has no %s header", HeaderScheduleTarget)
+	}
+	return due, target, nil
+}
+
+// dueMessage copies a scheduled message for delivery to target, without the headers used for scheduling.
+// Messages without a Nats-Msg-Id are given one derived from their place in the schedule stream,
+// so that a message delivered again by the next leader, before the previous one acknowledged it, is dropped.
+func dueMessage(msg jetstream.Msg, target string) (*nats.Msg, error) {
+	due := nats.NewMsg(target)
+	due.Data = msg.Data()
+	for key, values := range msg.Headers() {
+		if key == HeaderScheduleDeliverAt || key == HeaderScheduleTarget {
+			continue
+		}
+		for _, value := range values {
+			due.Header.Add(key, value)
+		}
+	}
+
+	if due.Header.Get(jetstream.MsgIDHeader) == "" {
+		metadata, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		due.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%s-%d", metadata.Stream, metadata.Sequence.Stream))
+	}
+	return due, nil
+}
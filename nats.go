@@ -18,8 +18,16 @@
 //   - Connection: *nats.Conn
 //   - Subscription: *nats.Subscription
 //   - Message.BeforeSend: *nats.Msg for v2.
-//   - Message.AfterSend: None.
-//   - Message: *nats.Msg
+//   - Message.AfterSend: *nats.Msg, and *jetstream.PubAck when using jetstream.
+//   - Message: *nats.Msg, or jetstream.Msg and connections.Terminator when using jetstream,
+//     and connections.Responder for requests. nats.Header gives the headers as received
+//     and connections.HeaderCodec the codec they were decoded with.
+//
+// # Metadata
+//
+// Metadata keys and values are written to headers through the connections.HeaderCodec of the topic, query escaped
+// by default, and read back through the codec of the subscription. A header carrying several values is received as
+// one metadata entry per value, named key, key[1], key[2] and so on, which are published back as a single header.
 //
 //	This implementation does not support nats version 1.0, actually from nats v2.2 onwards only.
 //
@@ -29,18 +37,23 @@ package natspubsub
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pitabwire/natspubsub/connections"
+	"io"
 	"net/url"
 	"path"
 	"regexp"
 	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/pubsub"
@@ -48,15 +61,43 @@ import (
 	"gocloud.dev/pubsub/driver"
 )
 
+// Metadata keys setting the expectations jetstream checks before storing a message, for compare and set appends.
+// A message whose expectations do not hold is rejected with gcerrors.FailedPrecondition.
+const (
+	MetadataExpectedStream              = jetstream.ExpectedStreamHeader
+	MetadataExpectedLastSequence        = jetstream.ExpectedLastSeqHeader
+	MetadataExpectedLastSubjectSequence = jetstream.ExpectedLastSubjSeqHeader
+	MetadataExpectedLastMsgID           = jetstream.ExpectedLastMsgIDHeader
+)
+
+// Error codes of rejected expectations that the jetstream client does not name.
+const (
+	errCodeStreamNotMatch       jetstream.ErrorCode = 10060
+	errCodeStreamWrongLastMsgID jetstream.ErrorCode = 10070
+)
+
 var errInvalidUrl = errors.New("natspubsub: invalid connection url")
 var errNotSubjectInitialized = errors.New("natspubsub: subject not initialized")
 var errDuplicateParameter = errors.New("natspubsub: avoid specifying parameters more than once")
+var errResetNotSupported = errors.New("natspubsub: connection does not support resetting consumers")
+var errTerminateNotSupported = errors.New("natspubsub: message can not be terminated")
+var errRespondNotSupported = errors.New("natspubsub: message was not sent as a request")
+var errConflictingSubjectRouting = errors.New("natspubsub: only one of subject template or subject func can be set")
+var errUnresolvedPlaceholder = errors.New("natspubsub: subject placeholder has no metadata value")
 var errNotSupportedParameter = errors.New("natspubsub: invalid parameter used, only the parameters [subject, " +
 	"stream_name, stream_description, stream_subjects, consumer_max_count, consumer_max_batch_size, " +
-	"consumer_max_batch_bytes_size, consumer_queue, consumer_batch_timeout, jetstream ] are supported and can be used")
+	"consumer_max_batch_bytes_size, consumer_name, consumer_queue, queue, consumer_batch_timeout, " +
+	"consumer_inactive_threshold, consumer_filter_subjects, consumer_pending_msgs_limit, " +
+	"consumer_pending_bytes_limit, consumer_ack_mode, consumer_ack_wait, consumer_max_deliver, consumer_backoff, consumer_lease_fraction, " +
+	"consumer_lease_max, consumer_terminate_undecodable, dlq_subject, deliver, start_seq, start_time, acknowledged, header_codec, " +
+	"jetstream ] " +
+	"are supported and can be used")
 var allowedParameters = []string{"subject", "stream_name", "stream_description", "stream_subjects",
-	"consumer_max_count", "consumer_max_batch_size", "consumer_max_batch_bytes_size", "consumer_queue",
-	"jetstream", "consumer_batch_timeout"}
+	"consumer_max_count", "consumer_max_batch_size", "consumer_max_batch_bytes_size", "consumer_name",
+	"consumer_queue", "queue", "jetstream", "consumer_batch_timeout", "consumer_inactive_threshold",
+	"consumer_filter_subjects", "consumer_pending_msgs_limit", "consumer_pending_bytes_limit", "consumer_ack_mode",
+	"consumer_ack_wait", "consumer_max_deliver", "consumer_backoff", "consumer_lease_fraction", "consumer_lease_max",
+	"consumer_terminate_undecodable", "dlq_subject", "deliver", "start_seq", "start_time", "acknowledged", "header_codec"}
 
 func init() {
 	o := new(defaultDialer)
@@ -81,6 +122,11 @@ func (o *defaultDialer) defaultConn(_ context.Context, serverUrl *url.URL) (*URL
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
+	err := validateParameters(serverUrl.Query())
+	if err != nil {
+		return nil, err
+	}
+
 	connectionUrl := strings.Replace(serverUrl.String(), serverUrl.RequestURI(), "", 1)
 
 	storedOpener, ok := o.openerMap.Load(connectionUrl)
@@ -88,18 +134,6 @@ func (o *defaultDialer) defaultConn(_ context.Context, serverUrl *url.URL) (*URL
 		return storedOpener.(*URLOpener), nil
 	}
 
-	for param, values := range serverUrl.Query() {
-		paramName := strings.ToLower(param)
-		if slices.Contains(allowedParameters, paramName) {
-			return nil, errNotSupportedParameter
-		}
-
-		if len(values) != 1 {
-			return nil, errDuplicateParameter
-		}
-
-	}
-
 	conn, err := o.createConnection(connectionUrl, serverUrl.Query().Has("jetstream"))
 	if err != nil {
 		return nil, err
@@ -114,6 +148,22 @@ func (o *defaultDialer) defaultConn(_ context.Context, serverUrl *url.URL) (*URL
 	return opener, nil
 }
 
+// validateParameters ensures only the supported url parameters are used and each only once.
+func validateParameters(query url.Values) error {
+	for param, values := range query {
+		paramName := strings.ToLower(param)
+		if !slices.Contains(allowedParameters, paramName) {
+			return errNotSupportedParameter
+		}
+
+		if len(values) != 1 {
+			return errDuplicateParameter
+		}
+
+	}
+	return nil
+}
+
 func (o *defaultDialer) createConnection(connectionUrl string, isJetstream bool) (connections.Connection, error) {
 	natsConn, err := nats.Connect(connectionUrl)
 	if err != nil {
@@ -132,13 +182,11 @@ func (o *defaultDialer) createConnection(connectionUrl string, isJetstream bool)
 	var conn connections.Connection
 	if isJetstream {
 
-		js, err := jetstream.New(natsConn)
+		conn, err = connections.NewJetstreamFromConn(natsConn)
 		if err != nil {
 			return nil, fmt.Errorf("natspubsub: failed to convert server to jetstream : %v", err)
 		}
 
-		conn = connections.NewJetstream(js)
-
 	} else {
 
 		conn = connections.NewPlain(natsConn)
@@ -166,6 +214,9 @@ func (o *defaultDialer) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*p
 
 var semVerRegexp = regexp.MustCompile(`\Av?([0-9]+)\.?([0-9]+)?\.?([0-9]+)?`)
 
+// subjectPlaceholder matches the {name} placeholders of subject templates.
+var subjectPlaceholder = regexp.MustCompile(`\{[^{}.]+\}`)
+
 func parseServerVersion(version string) (serverVersion, error) {
 	m := semVerRegexp.FindStringSubmatch(version)
 	if m == nil {
@@ -219,6 +270,9 @@ type URLOpener struct {
 //		- nats://host:8934/bar?subject=foo --> foo/bar
 //		- nats://host:8934/bar --> /bar
 //		- nats://host:8934?no_subject=foo --> [this yields an error]
+//
+//	Over plain nats, acknowledged=true waits for a subscriber to acknowledge every message.
+//	header_codec [raw, query, base64] sets how metadata is written to headers, query escaped by default.
 func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic, error) {
 
 	subject := u.Query().Get("subject")
@@ -228,7 +282,26 @@ func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic
 		return nil, errNotSubjectInitialized
 	}
 
-	return OpenTopic(ctx, o.Connection, &o.TopicOptions)
+	opts := o.TopicOptions
+	opts.Subject = subject
+
+	if acknowledged := u.Query().Get("acknowledged"); acknowledged != "" {
+		var err error
+		opts.Acknowledged, err = strconv.ParseBool(acknowledged)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid acknowledged %q: %w", acknowledged, err)
+		}
+	}
+
+	if codec := u.Query().Get("header_codec"); codec != "" {
+		var err error
+		opts.HeaderCodec, err = connections.HeaderCodecByName(codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return OpenTopic(ctx, o.Connection, &opts)
 
 }
 
@@ -246,18 +319,40 @@ func (o *URLOpener) OpenTopicURL(ctx context.Context, u *url.URL) (*pubsub.Topic
 //			- stream_description,
 //			- stream_subjects,
 //			- consumer_max_count,
-//			- consumer_queue
+//			- consumer_name,
+//			- consumer_queue,
+//			- consumer_inactive_threshold,
+//			- consumer_filter_subjects,
+//			- consumer_pending_msgs_limit,
+//			- consumer_pending_bytes_limit,
+//			- consumer_ack_mode [sync, fire_and_forget, async],
+//			- consumer_ack_wait [duration e.g. 30s],
+//			- consumer_max_deliver,
+//			- consumer_backoff [comma separated durations e.g. 1s,5s,30s],
+//			- consumer_lease_fraction [between 0 and 1 e.g. 0.5],
+//			- consumer_lease_max [duration e.g. 10m],
+//			- consumer_terminate_undecodable [true, false],
+//			- header_codec [raw, query, base64, has to match the codec of the publishers],
+//			- dlq_subject [jetstream only, receives messages that reached consumer_max_deliver],
+//			- acknowledged [true, false, plain nats only, answers acknowledged topics on ack and nack],
+//			- deliver [all, last, new, last_per_subject],
+//			- start_seq,
+//			- start_time [RFC3339]
 func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsub.Subscription, error) {
 
 	var err error
 	opts := o.SubscriptionOptions
-	setupOpts := opts.SetupOpts
+
+	setupOpts := &connections.SetupOptions{}
+	if opts.SetupOpts != nil {
+		*setupOpts = *opts.SetupOpts
+	}
 
 	subject := u.Query().Get("subject")
 	subjects := strings.Split(subject, ",")
 
-	for _, subj := range subjects {
-		subj = path.Join(subj, u.Path)
+	for i, subj := range subjects {
+		subjects[i] = path.Join(subj, u.Path)
 	}
 
 	if len(subjects) == 0 || "" == subjects[0] {
@@ -265,7 +360,39 @@ func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsu
 	}
 
 	setupOpts.Subjects = subjects
+	setupOpts.ConsumerName = u.Query().Get("consumer_name")
 	setupOpts.DurableQueue = u.Query().Get("consumer_queue")
+	if setupOpts.DurableQueue == "" {
+		setupOpts.DurableQueue = u.Query().Get("queue")
+	}
+
+	setupOpts.ConsumerInactiveThresholdMs, err = strconv.Atoi(u.Query().Get("consumer_inactive_threshold"))
+	if err != nil {
+		setupOpts.ConsumerInactiveThresholdMs = 0
+	}
+
+	setupOpts.ConsumerMaxDeliver, err = strconv.Atoi(u.Query().Get("consumer_max_deliver"))
+	if err != nil {
+		setupOpts.ConsumerMaxDeliver = 0
+	}
+
+	if ackWait := u.Query().Get("consumer_ack_wait"); ackWait != "" {
+		setupOpts.ConsumerAckWait, err = time.ParseDuration(ackWait)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid consumer ack wait %q: %w", ackWait, err)
+		}
+	}
+
+	if backOff := u.Query().Get("consumer_backoff"); backOff != "" {
+		setupOpts.ConsumerBackOff = nil
+		for _, wait := range strings.Split(backOff, ",") {
+			d, err := time.ParseDuration(wait)
+			if err != nil {
+				return nil, fmt.Errorf("natspubsub: invalid consumer backoff %q: %w", wait, err)
+			}
+			setupOpts.ConsumerBackOff = append(setupOpts.ConsumerBackOff, d)
+		}
+	}
 
 	opts.ConsumersMaxCount, err = strconv.Atoi(u.Query().Get("consumer_max_count"))
 	if err != nil {
@@ -285,18 +412,113 @@ func (o *URLOpener) OpenSubscriptionURL(ctx context.Context, u *url.URL) (*pubsu
 		opts.ConsumerMaxBatchTimeoutMs = 10000
 	}
 
+	opts.ConsumerPendingMsgsLimit, err = strconv.Atoi(u.Query().Get("consumer_pending_msgs_limit"))
+	if err != nil {
+		opts.ConsumerPendingMsgsLimit = 0
+	}
+	opts.ConsumerPendingBytesLimit, err = strconv.Atoi(u.Query().Get("consumer_pending_bytes_limit"))
+	if err != nil {
+		opts.ConsumerPendingBytesLimit = 0
+	}
+
 	setupOpts.StreamName = u.Query().Get("stream_name")
 	setupOpts.StreamDescription = u.Query().Get("stream_description")
-	setupOpts.Subjects = strings.Split(u.Query().Get("stream_subjects"), ",")
+	if streamSubjects := u.Query().Get("stream_subjects"); streamSubjects != "" {
+		setupOpts.Subjects = strings.Split(streamSubjects, ",")
+	}
+	if filterSubjects := u.Query().Get("consumer_filter_subjects"); filterSubjects != "" {
+		setupOpts.FilterSubjects = strings.Split(filterSubjects, ",")
+	}
 
 	opts.SetupOpts = setupOpts
 
+	if acknowledged := u.Query().Get("acknowledged"); acknowledged != "" {
+		opts.Acknowledged, err = strconv.ParseBool(acknowledged)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid acknowledged %q: %w", acknowledged, err)
+		}
+	}
+
+	if dlqSubject := u.Query().Get("dlq_subject"); dlqSubject != "" {
+		opts.DeadLetterSubject = dlqSubject
+	}
+
+	if terminate := u.Query().Get("consumer_terminate_undecodable"); terminate != "" {
+		opts.TerminateUndecodable, err = strconv.ParseBool(terminate)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid consumer_terminate_undecodable %q: %w", terminate, err)
+		}
+	}
+
+	if codec := u.Query().Get("header_codec"); codec != "" {
+		opts.HeaderCodec, err = connections.HeaderCodecByName(codec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if leaseFraction := u.Query().Get("consumer_lease_fraction"); leaseFraction != "" {
+		opts.LeaseRenewalFraction, err = strconv.ParseFloat(leaseFraction, 64)
+		if err != nil || opts.LeaseRenewalFraction <= 0 || opts.LeaseRenewalFraction >= 1 {
+			return nil, fmt.Errorf("natspubsub: invalid lease fraction %q, use a value between 0 and 1", leaseFraction)
+		}
+	}
+
+	if leaseMax := u.Query().Get("consumer_lease_max"); leaseMax != "" {
+		opts.LeaseMaxDuration, err = time.ParseDuration(leaseMax)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid lease max duration %q: %w", leaseMax, err)
+		}
+	}
+
+	switch ackMode := u.Query().Get("consumer_ack_mode"); ackMode {
+	case "":
+	case "sync":
+		opts.AckMode = connections.AckSync
+	case "fire_and_forget":
+		opts.AckMode = connections.AckFireAndForget
+	case "async":
+		opts.AckMode = connections.AckAsync
+	default:
+		return nil, fmt.Errorf("natspubsub: invalid ack mode %q, use one of [sync, fire_and_forget, async]", ackMode)
+	}
+
+	if deliver := u.Query().Get("deliver"); deliver != "" {
+		err = opts.DeliverPolicy.UnmarshalJSON([]byte(strconv.Quote(deliver)))
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid deliver policy %q: %w", deliver, err)
+		}
+	}
+
+	if startSeq := u.Query().Get("start_seq"); startSeq != "" {
+		opts.StartSequence, err = strconv.ParseUint(startSeq, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid start sequence %q: %w", startSeq, err)
+		}
+	}
+
+	if startTime := u.Query().Get("start_time"); startTime != "" {
+		st, err := time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			return nil, fmt.Errorf("natspubsub: invalid start time %q: %w", startTime, err)
+		}
+		opts.StartTime = &st
+	}
+
 	return OpenSubscription(ctx, o.Connection, &opts)
 
 }
 
 type topic struct {
 	iTopic connections.Topic
+
+	subjectTemplate string
+	subjectFunc     func(body []byte, metadata map[string]string) (string, error)
+
+	idSource      connections.MessageIDSource
+	idMetadataKey string
+
+	headerCodec connections.HeaderCodec
 }
 
 // OpenTopic returns a *pubsub.Topic for use with NATS at least version 2.2.0.
@@ -310,7 +532,15 @@ func OpenTopic(ctx context.Context, conn connections.Connection, opts *connectio
 	if err != nil {
 		return nil, err
 	}
-	return pubsub.NewTopic(dt, nil), nil
+
+	var sendBatcherOpts = &batcher.Options{
+		MaxBatchSize:     opts.MaxBatchSize,
+		MinBatchSize:     opts.MinBatchSize,
+		MaxHandlers:      opts.MaxHandlers,
+		MaxBatchByteSize: opts.MaxBatchByteSize,
+	}
+
+	return pubsub.NewTopic(dt, sendBatcherOpts), nil
 }
 
 // openTopic returns the driver for OpenTopic. This function exists so the test
@@ -320,12 +550,90 @@ func openTopic(ctx context.Context, conn connections.Connection, opts *connectio
 		return nil, errInvalidUrl
 	}
 
+	if opts.SubjectTemplate != "" && opts.SubjectFunc != nil {
+		return nil, errConflictingSubjectRouting
+	}
+	if opts.SubjectTemplate != "" {
+		if err := validateSubjectTemplate(opts.SubjectTemplate); err != nil {
+			return nil, err
+		}
+	}
+
 	itopic, err := conn.CreateTopic(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return &topic{iTopic: itopic}, nil
+	return &topic{
+		iTopic:          itopic,
+		idSource:        opts.MessageIDSource,
+		idMetadataKey:   opts.MessageIDMetadataKey,
+		subjectTemplate: opts.SubjectTemplate,
+		subjectFunc:     opts.SubjectFunc,
+		headerCodec:     opts.HeaderCodec,
+	}, nil
+}
+
+// subjectFor picks the subject m is published to, the topic subject unless messages are routed individually.
+func (t *topic) subjectFor(m *driver.Message) (string, error) {
+	var subject string
+	var err error
+	switch {
+	case t.subjectFunc != nil:
+		subject, err = t.subjectFunc(m.Body, m.Metadata)
+		if err != nil {
+			return "", err
+		}
+	case t.subjectTemplate != "":
+		subject, err = fillSubjectTemplate(t.subjectTemplate, m.Metadata)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return t.iTopic.Subject(), nil
+	}
+
+	return subject, validatePublishSubject(subject)
+}
+
+// fillSubjectTemplate replaces every placeholder of template with the metadata value of the same name.
+func fillSubjectTemplate(template string, metadata map[string]string) (string, error) {
+	var unresolved []string
+	subject := subjectPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := metadata[placeholder[1:len(placeholder)-1]]
+		if value == "" {
+			unresolved = append(unresolved, placeholder)
+		}
+		return value
+	})
+
+	if len(unresolved) > 0 {
+		return "", fmt.Errorf("%w : %s in %q", errUnresolvedPlaceholder, strings.Join(unresolved, ", "), template)
+	}
+	return subject, nil
+}
+
+// validateSubjectTemplate checks that placeholders are well formed and that the rest of the template is a valid subject.
+func validateSubjectTemplate(template string) error {
+	stripped := subjectPlaceholder.ReplaceAllString(template, "x")
+	if strings.ContainsAny(stripped, "{}") {
+		return fmt.Errorf("%w : malformed placeholder in %q", nats.ErrBadSubject, template)
+	}
+	return validatePublishSubject(stripped)
+}
+
+// validatePublishSubject rejects subjects messages can not be published to, those with wildcards or empty tokens.
+func validatePublishSubject(subject string) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("%w : %q", nats.ErrBadSubject, subject)
+	}
+
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return fmt.Errorf("%w : %q", nats.ErrBadSubject, subject)
+		}
+	}
+	return nil
 }
 
 // SendBatch implements driver.Connection.SendBatch.
@@ -334,6 +642,10 @@ func (t *topic) SendBatch(ctx context.Context, msgs []*driver.Message) error {
 		return errNotSubjectInitialized
 	}
 
+	if publisher, ok := t.iTopic.(connections.BatchPublisher); ok {
+		return t.publishBatch(ctx, publisher, msgs)
+	}
+
 	for _, m := range msgs {
 		err := ctx.Err()
 		if err != nil {
@@ -349,8 +661,73 @@ func (t *topic) SendBatch(ctx context.Context, msgs []*driver.Message) error {
 	return nil
 }
 
+// publishBatch hands the whole batch to the publisher at once, messages that were published
+// are passed to AfterSend even when others in the batch failed.
+func (t *topic) publishBatch(ctx context.Context, publisher connections.BatchPublisher, msgs []*driver.Message) error {
+	natsMsgs := make([]*nats.Msg, 0, len(msgs))
+	for _, m := range msgs {
+		msg, err := t.prepareMessage(m)
+		if err != nil {
+			return err
+		}
+		natsMsgs = append(natsMsgs, msg)
+	}
+
+	acks, err := publisher.PublishMessages(ctx, natsMsgs)
+
+	var batchErr *connections.PublishBatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return err
+	}
+
+	for i, m := range msgs {
+		if batchErr != nil && batchErr.Failed[i] != nil {
+			continue
+		}
+		var ack *jetstream.PubAck
+		if i < len(acks) {
+			ack = acks[i]
+		}
+		if err0 := afterSend(m, natsMsgs[i], ack); err0 != nil {
+			return err0
+		}
+	}
+	return err
+}
+
 func (t *topic) sendMessage(ctx context.Context, m *driver.Message) error {
-	msg := encodeMessage(m, t.iTopic.Subject())
+	msg, err := t.prepareMessage(m)
+	if err != nil {
+		return err
+	}
+
+	ack, err := t.iTopic.PublishMessage(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	return afterSend(m, msg, ack)
+}
+
+// prepareMessage encodes m for the topic subject and lets BeforeSend amend it.
+func (t *topic) prepareMessage(m *driver.Message) (*nats.Msg, error) {
+	subject, err := t.subjectFor(m)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := encodeMessage(m, subject, t.headerCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	if id := t.messageID(m); id != "" {
+		if msg.Header == nil {
+			msg.Header = nats.Header{}
+		}
+		msg.Header.Set(jetstream.MsgIDHeader, id)
+	}
+
 	if m.BeforeSend != nil {
 		asFunc := func(i interface{}) bool {
 			if nm, ok := i.(**nats.Msg); ok {
@@ -360,16 +737,58 @@ func (t *topic) sendMessage(ctx context.Context, m *driver.Message) error {
 			return false
 		}
 		if err := m.BeforeSend(asFunc); err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return msg, nil
+}
 
-	if _, err := t.iTopic.PublishMessage(ctx, msg); err != nil {
-		return err
+// messageID picks the deduplication id of m from the configured source.
+func (t *topic) messageID(m *driver.Message) string {
+	switch t.idSource {
+	case connections.MessageIDFromMetadata:
+		return m.Metadata[t.idMetadataKey]
+	case connections.MessageIDFromContentHash:
+		return contentHash(m)
+	default:
+		return ""
 	}
+}
+
+// contentHash digests the body and metadata of m, metadata is hashed in key order to be stable.
+func contentHash(m *driver.Message) string {
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(hash, "%q=%q;", k, m.Metadata[k])
+	}
+	hash.Write(m.Body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
 
+// afterSend hands the published message to AfterSend, along with its stream acknowledgement when there is one.
+func afterSend(m *driver.Message, msg *nats.Msg, ack *jetstream.PubAck) error {
 	if m.AfterSend != nil {
-		asFunc := func(i interface{}) bool { return false }
+		asFunc := func(i interface{}) bool {
+			switch p := i.(type) {
+			case **nats.Msg:
+				*p = msg
+				return true
+			case **jetstream.PubAck:
+				if ack == nil {
+					return false
+				}
+				*p = ack
+				return true
+			}
+			return false
+		}
 		if err := m.AfterSend(asFunc); err != nil {
 			return err
 		}
@@ -382,16 +801,25 @@ func (*topic) IsRetryable(error) bool { return false }
 
 // As implements driver.Connection.As.
 func (t *topic) As(i interface{}) bool {
-	c, ok := i.(*connections.Topic)
-	if !ok {
-		return false
+	switch c := i.(type) {
+	case *connections.Topic:
+		*c = t.iTopic
+		return true
+	case *connections.HeaderCodec:
+		*c = t.headerCodec
+		if *c == nil {
+			*c = connections.QueryEscapeHeaderCodec{}
+		}
+		return true
 	}
-	*c = t.iTopic
-	return true
+	return false
 }
 
-// ErrorAs implements driver.Connection.ErrorAs
-func (*topic) ErrorAs(error, interface{}) bool {
+// ErrorAs implements driver.Connection.ErrorAs, exposing which messages of a batch failed to publish.
+func (*topic) ErrorAs(err error, i interface{}) bool {
+	if p, ok := i.(**connections.PublishBatchError); ok {
+		return errors.As(err, p)
+	}
 	return false
 }
 
@@ -406,16 +834,44 @@ func (*topic) ErrorCode(err error) gcerrors.ErrorCode {
 		return gcerrors.NotFound
 	case errors.Is(err, nats.ErrBadSubject):
 		return gcerrors.FailedPrecondition
+	case errors.Is(err, connections.ErrInvalidHeader):
+		return gcerrors.InvalidArgument
 	case errors.Is(err, nats.ErrAuthorization):
 		return gcerrors.PermissionDenied
-	case errors.Is(err, nats.ErrMaxPayload), errors.Is(err, nats.ErrReconnectBufExceeded):
+	case errors.Is(err, nats.ErrMaxPayload), errors.Is(err, nats.ErrReconnectBufExceeded),
+		errors.Is(err, connections.ErrOutboxFull):
 		return gcerrors.ResourceExhausted
+	case isExpectationError(err), errors.Is(err, errUnresolvedPlaceholder):
+		return gcerrors.FailedPrecondition
 	}
 	return gcerrors.Unknown
 }
 
-// Close implements driver.Connection.Close.
-func (*topic) Close() error { return nil }
+// isExpectationError reports whether the stream rejected a publish because one of its expectations did not hold,
+// meaning another writer got there first.
+func isExpectationError(err error) bool {
+	var apiErr *jetstream.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode {
+	case jetstream.JSErrCodeStreamWrongLastSequence, errCodeStreamWrongLastMsgID, errCodeStreamNotMatch:
+		return true
+	}
+	return false
+}
+
+// Close implements driver.Connection.Close, closing the connection topic when it holds resources such as an outbox.
+func (t *topic) Close() error {
+	if t == nil {
+		return nil
+	}
+	if closer, ok := t.iTopic.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
 
 type subscription struct {
 	queue connections.Queue
@@ -452,6 +908,94 @@ func OpenSubscription(ctx context.Context, conn connections.Connection, opts *co
 	return pubsub.NewSubscription(ds, recvBatcherOpts, nil), nil
 }
 
+// ResetConsumer moves an existing durable consumer to the replay position given in opts,
+// by recreating it from the supplied start sequence, start time or deliver policy.
+// This allows events to be reprocessed, for example after a bug fix, without creating a new consumer.
+func ResetConsumer(ctx context.Context, conn connections.Connection, opts *connections.SubscriptionOptions) error {
+	if opts == nil || opts.SetupOpts == nil {
+		return errors.New("natspubsub: subscription options missing")
+	}
+
+	resetter, ok := conn.(connections.ConsumerResetter)
+	if !ok {
+		return errResetNotSupported
+	}
+
+	return resetter.ResetConsumer(ctx, opts)
+}
+
+// Request publishes msg on topic as a request and waits for the first reply, until ctx is done.
+// Replies only carry a body and metadata.
+func Request(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message) (*pubsub.Message, error) {
+	replies, err := Gather(ctx, topic, msg, 1)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Gather publishes msg on topic as a request and collects the replies of every responder, for fan out queries.
+// It returns once count replies arrived or, when count is below one or not reached, once ctx is done.
+// The context error is only returned when no reply arrived at all.
+func Gather(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message, count int) ([]*pubsub.Message, error) {
+	var iTopic connections.Topic
+	if topic == nil || msg == nil || !topic.As(&iTopic) {
+		return nil, connections.ErrRequestNotSupported
+	}
+
+	requester, ok := iTopic.(connections.Requester)
+	if !ok {
+		return nil, connections.ErrRequestNotSupported
+	}
+
+	var codec connections.HeaderCodec
+	topic.As(&codec)
+	request, err := encodeMessage(&driver.Message{Body: msg.Body, Metadata: msg.Metadata}, iTopic.Subject(), codec)
+	if err != nil {
+		return nil, err
+	}
+	dms, err := requester.Request(ctx, request, count)
+
+	replies := make([]*pubsub.Message, 0, len(dms))
+	for _, dm := range dms {
+		replies = append(replies, &pubsub.Message{Body: dm.Body, Metadata: dm.Metadata})
+	}
+	return replies, err
+}
+
+// Respond sends reply to the requester of a received message.
+func Respond(ctx context.Context, received *pubsub.Message, reply *pubsub.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var responder connections.Responder
+	if received == nil || reply == nil || !received.As(&responder) {
+		return errRespondNotSupported
+	}
+
+	// Replies are encoded with the codec the request was received with, requesters decode them with the same one.
+	var codec connections.HeaderCodec
+	received.As(&codec)
+	msg, err := encodeMessage(&driver.Message{Body: reply.Body, Metadata: reply.Metadata}, "", codec)
+	if err != nil {
+		return err
+	}
+	return responder.Respond(msg)
+}
+
+// Terminate tells the server to stop redelivering a received message that can never be processed successfully.
+// The reason is logged along with the stream sequence of the message.
+// Only messages received from jetstream can be terminated.
+func Terminate(msg *pubsub.Message, reason string) error {
+	var terminator connections.Terminator
+	if msg == nil || !msg.As(&terminator) {
+		return errTerminateNotSupported
+	}
+
+	return terminator.Terminate(reason)
+}
+
 func openSubscription(ctx context.Context, conn connections.Connection, opts *connections.SubscriptionOptions) (driver.Subscription, error) {
 	if opts == nil {
 		return nil, errors.New("natspubsub: subscription options missing")
@@ -476,11 +1020,10 @@ func (s *subscription) ReceiveBatch(ctx context.Context, batchCount int) ([]*dri
 
 // SendAcks implements driver.Subscription.SendAcks.
 func (s *subscription) SendAcks(ctx context.Context, ids []driver.AckID) error {
-	// Ack is a no-op.
 	return s.queue.Ack(ctx, ids)
 }
 
-// CanNack implements driver.CanNack.
+// CanNack implements driver.CanNack, only queues that redeliver messages can be nacked.
 func (s *subscription) CanNack() bool { return s != nil && s.queue != nil && s.queue.IsDurable() }
 
 // SendNacks implements driver.Subscription.SendNacks
@@ -519,30 +1062,39 @@ func (*subscription) ErrorCode(err error) gcerrors.ErrorCode {
 		return gcerrors.NotFound
 	case errors.Is(err, nats.ErrBadSubject), errors.Is(err, nats.ErrTypeSubscription):
 		return gcerrors.FailedPrecondition
+	case errors.Is(err, nats.ErrMsgNotBound), errors.Is(err, nats.ErrMsgNoReply),
+		errors.Is(err, jetstream.ErrMsgNotBound), errors.Is(err, jetstream.ErrMsgNoReply),
+		errors.Is(err, jetstream.ErrMsgAlreadyAckd), errors.Is(err, nats.ErrConnectionClosed):
+		return gcerrors.FailedPrecondition
+	case errors.Is(err, connections.ErrNackNotSupported):
+		return gcerrors.Unimplemented
 	case errors.Is(err, nats.ErrAuthorization):
 		return gcerrors.PermissionDenied
 	case errors.Is(err, nats.ErrMaxMessages), errors.Is(err, nats.ErrSlowConsumer):
 		return gcerrors.ResourceExhausted
-	case errors.Is(err, nats.ErrTimeout):
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
 		return gcerrors.DeadlineExceeded
 	}
 	return gcerrors.Unknown
 }
 
-// Close implements driver.Subscription.Close.
-func (*subscription) Close() error { return nil }
+// Close implements driver.Subscription.Close, unsubscribing the queue so that its background work stops
+// and the resources it created on the server for itself are removed.
+func (s *subscription) Close() error {
+	if s == nil || s.queue == nil {
+		return nil
+	}
+	return s.queue.Unsubscribe()
+}
 
-func encodeMessage(dm *driver.Message, sub string) *nats.Msg {
-	var header nats.Header
-	if dm.Metadata != nil {
-		header = nats.Header{}
-		for k, v := range dm.Metadata {
-			header[url.QueryEscape(k)] = []string{url.QueryEscape(v)}
-		}
+func encodeMessage(dm *driver.Message, sub string, codec connections.HeaderCodec) (*nats.Msg, error) {
+	header, err := connections.EncodeMetadata(dm.Metadata, codec)
+	if err != nil {
+		return nil, err
 	}
 	return &nats.Msg{
 		Subject: sub,
 		Data:    dm.Body,
 		Header:  header,
-	}
+	}, nil
 }
@@ -17,12 +17,23 @@ package natspubsub
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go/jetstream"
 	"github.com/pitabwire/natspubsub/connections"
 	"gocloud.dev/pubsub/batcher"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gocloud.dev/gcerrors"
 	"gocloud.dev/pubsub"
@@ -51,13 +62,15 @@ func newPlainHarness(ctx context.Context, t *testing.T) (drivertest.Harness, err
 
 	plainConn := connections.NewPlain(nc)
 
-	return &harness{s: s, conn: plainConn}, nil
+	return &harness{s: s, nc: nc, conn: plainConn}, nil
 }
 
-func newJetstreamHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+// newJetstreamOnlyHarness builds the connection with NewJetstream, which knows nothing of the underlying nats connection.
+func newJetstreamOnlyHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
 	opts := gnatsd.DefaultTestOptions
 	opts.Port = testPort
 	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
 	s := gnatsd.RunServer(&opts)
 	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort))
 	if err != nil {
@@ -69,13 +82,31 @@ func newJetstreamHarness(ctx context.Context, t *testing.T) (drivertest.Harness,
 		return nil, err
 	}
 
-	jsConn := connections.NewJetstream(js)
+	return &harness{s: s, nc: nc, conn: connections.NewJetstream(js)}, nil
+}
+
+func newJetstreamHarness(ctx context.Context, t *testing.T) (drivertest.Harness, error) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := gnatsd.RunServer(&opts)
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort))
+	if err != nil {
+		return nil, err
+	}
+
+	jsConn, err := connections.NewJetstreamFromConn(nc)
+	if err != nil {
+		return nil, err
+	}
 
-	return &harness{s: s, conn: jsConn}, nil
+	return &harness{s: s, nc: nc, conn: jsConn}, nil
 }
 
 type harness struct {
 	s    *server.Server
+	nc   *nats.Conn
 	conn connections.Connection
 }
 
@@ -96,12 +127,17 @@ func (h *harness) MakeNonexistentTopic(ctx context.Context) (driver.Topic, error
 	return (*topic)(nil), nil
 }
 
+// sanitizeName makes test names usable as stream and consumer names, which may not contain path separators or dots.
+func sanitizeName(name string) string {
+	return strings.NewReplacer("/", "_", ".", "_", " ", "_", "*", "_", ">", "_").Replace(name)
+}
+
 func defaultSubOptions(subject, testName string) *connections.SubscriptionOptions {
 
 	sOpts := &connections.SetupOptions{
-		StreamName:   fmt.Sprintf("test_stream_%s", testName),
+		StreamName:   fmt.Sprintf("test_stream_%s", sanitizeName(testName)),
 		Subjects:     []string{subject},
-		DurableQueue: testName,
+		DurableQueue: sanitizeName(testName),
 	}
 
 	opts := &connections.SubscriptionOptions{
@@ -116,7 +152,9 @@ func (h *harness) CreateSubscription(ctx context.Context, dt driver.Topic, testN
 	var tp connections.Topic
 	dt.As(&tp)
 
+	// Subscriptions each receive every message, so no durable queue is shared between them.
 	opts := defaultSubOptions(tp.Subject(), testName)
+	opts.SetupOpts.DurableQueue = ""
 	ds, err := openSubscription(ctx, h.conn, opts)
 	if err != nil {
 		return nil, nil, err
@@ -218,6 +256,10 @@ func (plainNatsAsTest) MessageCheck(m *pubsub.Message) error {
 	if !m.As(&ppm) {
 		return fmt.Errorf("cast failed for %T", &ppm)
 	}
+	var header nats.Header
+	if !m.As(&header) {
+		return fmt.Errorf("cast failed for %T", &header)
+	}
 	return nil
 }
 
@@ -235,6 +277,20 @@ func (n plainNatsAsTest) BeforeSend(as func(interface{}) bool) error {
 }
 
 func (plainNatsAsTest) AfterSend(as func(interface{}) bool) error {
+	var pm *nats.Msg
+	if as(pm) {
+		return fmt.Errorf("cast succeeded for %T, want failure", &pm)
+	}
+
+	var ppm *nats.Msg
+	if !as(&ppm) {
+		return fmt.Errorf("cast failed for %T", &ppm)
+	}
+
+	var ack *jetstream.PubAck
+	if as(&ack) {
+		return fmt.Errorf("cast succeeded for %T, want failure", &ack)
+	}
 	return nil
 }
 
@@ -275,6 +331,35 @@ func (jetstreamAsTest) MessageCheck(m *pubsub.Message) error {
 	if !m.As(&ppm) {
 		return fmt.Errorf("cast failed for %T", ppm)
 	}
+	var terminator connections.Terminator
+	if !m.As(&terminator) {
+		return fmt.Errorf("cast failed for %T", &terminator)
+	}
+	var header nats.Header
+	if !m.As(&header) {
+		return fmt.Errorf("cast failed for %T", &header)
+	}
+	return nil
+}
+
+func (jetstreamAsTest) AfterSend(as func(interface{}) bool) error {
+	var ppm *nats.Msg
+	if !as(&ppm) {
+		return fmt.Errorf("cast failed for %T", &ppm)
+	}
+
+	var pa jetstream.PubAck
+	if as(&pa) {
+		return fmt.Errorf("cast succeeded for %T, want failure", &pa)
+	}
+
+	var ack *jetstream.PubAck
+	if !as(&ack) {
+		return fmt.Errorf("cast failed for %T", &ack)
+	}
+	if ack.Stream == "" || ack.Sequence == 0 {
+		return fmt.Errorf("expected the stream and sequence to be acknowledged, got %+v", ack)
+	}
 	return nil
 }
 
@@ -296,6 +381,11 @@ func TestConformanceJetstream(t *testing.T) {
 	drivertest.RunConformanceTests(t, newJetstreamHarness, asTests)
 }
 
+func TestConformanceJetstreamOnly(t *testing.T) {
+	asTests := []drivertest.AsTest{jetstreamAsTest{}}
+	drivertest.RunConformanceTests(t, newJetstreamOnlyHarness, asTests)
+}
+
 func TestConformancePlain(t *testing.T) {
 	asTests := []drivertest.AsTest{plainNatsAsTest{}}
 	drivertest.RunConformanceTests(t, newPlainHarness, asTests)
@@ -388,7 +478,7 @@ func TestJetstreamInteropWithDirectNATS(t *testing.T) {
 	js := conn.Raw().(jetstream.JetStream)
 
 	stream, err := js.Stream(ctx, topic)
-	if err != nil && !errors.Is(err, nats.ErrStreamNotFound) {
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNotFound) {
 		t.Fatal(err)
 	}
 
@@ -454,155 +544,3350 @@ func TestJetstreamInteropWithDirectNATS(t *testing.T) {
 	}
 }
 
-func TestErrorCode(t *testing.T) {
+func TestJetstreamConsumersFanOutFromOneStream(t *testing.T) {
 	ctx := context.Background()
 	dh, err := newJetstreamHarness(ctx, t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer dh.Close()
-	h := dh.(*harness)
+	conn := dh.(*harness).conn
 
-	// Topics
-	dt, err := openTopic(ctx, h.conn, &connections.TopicOptions{Subject: "bar"})
+	const subject = "fanout"
+	body := []byte("hello")
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer pt.Shutdown(ctx)
 
-	if gce := dt.ErrorCode(nil); gce != gcerrors.OK {
-		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
-	}
-	if gce := dt.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
-		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+	var subs []*pubsub.Subscription
+	for _, consumer := range []string{"billing", "shipping"} {
+		opts := defaultSubOptions(subject, t.Name())
+		opts.SetupOpts.ConsumerName = consumer
+		opts.SetupOpts.DurableQueue = consumer
+
+		ps, err := OpenSubscription(ctx, conn, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ps.Shutdown(ctx)
+		subs = append(subs, ps)
 	}
-	if gce := dt.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
-		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+
+	if err = pt.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+		t.Fatal(err)
 	}
-	if gce := dt.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
-		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+
+	for i, ps := range subs {
+		msg, err := ps.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Ack()
+		if !bytes.Equal(msg.Body, body) {
+			t.Fatalf("sub #%d: Data did not match. %q vs %q\n", i, msg.Body, body)
+		}
 	}
-	if gce := dt.ErrorCode(nats.ErrMaxPayload); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+}
+
+func TestJetstreamConsumerNameMismatch(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := dt.ErrorCode(nats.ErrReconnectBufExceeded); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	opts := defaultSubOptions("mismatch", t.Name())
+	opts.SetupOpts.ConsumerName = "billing"
+	opts.SetupOpts.DurableQueue = "shipping"
+
+	_, err = OpenSubscription(ctx, conn, opts)
+	if !errors.Is(err, connections.ErrConsumerNameMismatch) {
+		t.Fatalf("Expected %v, got %v", connections.ErrConsumerNameMismatch, err)
 	}
+}
 
-	// Subscriptions
-	opts := defaultSubOptions("bar", t.Name())
+func receiveBodies(ctx context.Context, t *testing.T, ps *pubsub.Subscription, count int) map[string]bool {
+	t.Helper()
 
-	ds, err := openSubscription(ctx, h.conn, opts)
+	bodies := map[string]bool{}
+	for i := 0; i < count; i++ {
+		msg, err := ps.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Ack()
+		bodies[string(msg.Body)] = true
+	}
+	return bodies
+}
+
+func TestJetstreamFilterSubjects(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gce := ds.ErrorCode(nil); gce != gcerrors.OK {
-		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
-	}
-	if gce := ds.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
-		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	opts := defaultSubOptions("orders.>", t.Name())
+	opts.SetupOpts.FilterSubjects = []string{"orders.created", "orders.cancelled"}
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := ds.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
-		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	defer ps.Shutdown(ctx)
+
+	js := conn.Raw().(jetstream.JetStream)
+	for _, subject := range []string{"orders.created", "orders.updated", "orders.cancelled"} {
+		if _, err = js.Publish(ctx, subject, []byte(subject)); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if gce := ds.ErrorCode(nats.ErrBadSubscription); gce != gcerrors.NotFound {
-		t.Fatalf("Expected %v, got %v", gcerrors.NotFound, gce)
+
+	got := receiveBodies(ctx, t, ps, 2)
+	if !got["orders.created"] || !got["orders.cancelled"] {
+		t.Fatalf("Expected only filtered subjects, got %v", got)
 	}
-	if gce := ds.ErrorCode(nats.ErrTypeSubscription); gce != gcerrors.FailedPrecondition {
-		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+}
+
+func TestPlainFilterSubjects(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := ds.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
-		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	opts := defaultSubOptions("orders.>", t.Name())
+	opts.SetupOpts.FilterSubjects = []string{"orders.created", "orders.cancelled"}
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := ds.ErrorCode(nats.ErrMaxMessages); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	defer ps.Shutdown(ctx)
+
+	natsConn := conn.Raw().(*nats.Conn)
+	for _, subject := range []string{"orders.created", "orders.updated", "orders.cancelled"} {
+		if err = natsConn.Publish(subject, []byte(subject)); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if gce := ds.ErrorCode(nats.ErrSlowConsumer); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+
+	got := receiveBodies(ctx, t, ps, 2)
+	if !got["orders.created"] || !got["orders.cancelled"] {
+		t.Fatalf("Expected only filtered subjects, got %v", got)
 	}
-	if gce := ds.ErrorCode(nats.ErrTimeout); gce != gcerrors.DeadlineExceeded {
-		t.Fatalf("Expected %v, got %v", gcerrors.DeadlineExceeded, gce)
+}
+
+func TestJetstreamReplayFromSequence(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
 
-	// Queue Subscription
-	opts = defaultSubOptions("bar", t.Name())
+	const subject = "replay"
 
-	qs, err := openSubscription(ctx, h.conn, opts)
+	opts := defaultSubOptions(subject, t.Name())
+	opts.StartSequence = 3
+
+	js := conn.Raw().(jetstream.JetStream)
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{Name: opts.SetupOpts.StreamName, Subjects: []string{subject}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if gce := qs.ErrorCode(nil); gce != gcerrors.OK {
-		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
-	}
-	if gce := qs.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
-		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+
+	for i := 1; i <= 5; i++ {
+		if _, err = js.Publish(ctx, subject, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if gce := qs.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
-		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := qs.ErrorCode(nats.ErrBadSubscription); gce != gcerrors.NotFound {
-		t.Fatalf("Expected %v, got %v", gcerrors.NotFound, gce)
+
+	got := receiveBodies(ctx, t, ps, 3)
+	if !got["3"] || !got["4"] || !got["5"] {
+		t.Fatalf("Expected messages from sequence 3 onwards, got %v", got)
 	}
-	if gce := qs.ErrorCode(nats.ErrTypeSubscription); gce != gcerrors.FailedPrecondition {
-		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	ps.Shutdown(ctx)
+
+	// Move the durable consumer back and reprocess the stream.
+	opts.StartSequence = 0
+	startTime := time.Now().Add(-time.Hour)
+	opts.StartTime = &startTime
+	if err = ResetConsumer(ctx, conn, opts); err != nil {
+		t.Fatal(err)
 	}
-	if gce := qs.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
-		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+
+	ps, err = OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := qs.ErrorCode(nats.ErrMaxMessages); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	defer ps.Shutdown(ctx)
+
+	got = receiveBodies(ctx, t, ps, 5)
+	if len(got) != 5 {
+		t.Fatalf("Expected all messages to be replayed, got %v", got)
 	}
-	if gce := qs.ErrorCode(nats.ErrSlowConsumer); gce != gcerrors.ResourceExhausted {
-		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+}
+
+func TestResetConsumerNotSupported(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if gce := qs.ErrorCode(nats.ErrTimeout); gce != gcerrors.DeadlineExceeded {
-		t.Fatalf("Expected %v, got %v", gcerrors.DeadlineExceeded, gce)
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	err = ResetConsumer(ctx, conn, defaultSubOptions("replay", t.Name()))
+	if !errors.Is(err, errResetNotSupported) {
+		t.Fatalf("Expected %v, got %v", errResetNotSupported, err)
 	}
 }
 
-func BenchmarkNatsQueuePubSub(b *testing.B) {
+func TestReceiveBoundedByBytes(t *testing.T) {
 	ctx := context.Background()
 
-	opts := gnatsd.DefaultTestOptions
-	opts.Port = benchPort
-	s := gnatsd.RunServer(&opts)
-	defer s.Shutdown()
+	tests := []struct {
+		name       string
+		newHarness drivertest.HarnessMaker
+	}{
+		{"Plain", newPlainHarness},
+		{"Jetstream", newJetstreamHarness},
+	}
 
-	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, benchPort))
-	if err != nil {
-		b.Fatal(err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dh, err := test.newHarness(ctx, t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dh.Close()
+			conn := dh.(*harness).conn
+
+			subject := sanitizeName(t.Name())
+			opts := defaultSubOptions(subject, t.Name())
+			opts.ConsumerMaxBatchBytesSize = 2500
+
+			ds, err := openSubscription(ctx, conn, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dt, err := openTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := bytes.Repeat([]byte("a"), 1000)
+			for i := 0; i < 5; i++ {
+				if err = dt.SendBatch(ctx, []*driver.Message{{Body: body}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			received := 0
+			for received < 5 {
+				msgs, err := ds.ReceiveBatch(ctx, 10)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				batchBytes := 0
+				for _, m := range msgs {
+					batchBytes += len(m.Body)
+				}
+				if batchBytes > opts.ConsumerMaxBatchBytesSize {
+					t.Fatalf("Expected at most %d bytes per batch, got %d", opts.ConsumerMaxBatchBytesSize, batchBytes)
+				}
+				received += len(msgs)
+			}
+		})
 	}
-	defer nc.Close()
+}
 
-	js, err := jetstream.New(nc)
+func TestJetstreamBytesBoundReceiveKeepsSurplus(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
+	defer dh.Close()
+	h := dh.(*harness)
 
-	conn := connections.NewJetstream(js)
+	subject := sanitizeName(t.Name())
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchBytesSize = 10000
+	opts.ConsumerMaxBatchTimeoutMs = 200
+	opts.SetupOpts.ConsumerAckWait = time.Second
+	opts.SetupOpts.ConsumerMaxDeliver = 2
 
-	h := &harness{s: s, conn: conn}
+	queue, err := h.conn.CreateSubscription(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Unsubscribe()
 
-	b.Run("Jetstream", func(b *testing.B) {
-		dt, cleanup, err := h.CreateTopic(ctx, b.Name())
-		if err != nil {
-			b.Fatal(err)
+	js, err := jetstream.New(h.nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 5
+	for i := 0; i < count; i++ {
+		if _, err = js.Publish(ctx, subject, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
 		}
-		defer cleanup()
+	}
 
-		qs, cleanup, err := h.CreateQueueSubscription(ctx, dt, b.Name())
-		if err != nil {
-			b.Fatal(err)
+	// The surplus of the fetch outlives its ack wait without using up a delivery, so every message is handed out once.
+	receiveCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	received := map[string]bool{}
+	for len(received) < count {
+		msgs, err0 := queue.ReceiveMessages(receiveCtx, 1)
+		if err0 != nil {
+			t.Fatalf("Expected all %d messages, got %d : %v", count, len(received), err0)
 		}
-		defer cleanup()
 
-		topic := pubsub.NewTopic(dt, nil)
-		defer topic.Shutdown(ctx)
+		for _, m := range msgs {
+			msg := m.AckID.(jetstream.Msg)
+			metadata, err1 := msg.Metadata()
+			if err1 != nil {
+				t.Fatal(err1)
+			}
+			if metadata.NumDelivered != 1 {
+				t.Fatalf("Expected %q to be delivered once, got %d", m.Body, metadata.NumDelivered)
+			}
+			received[string(m.Body)] = true
+
+			if err1 = queue.Ack(ctx, []driver.AckID{m.AckID}); err1 != nil {
+				t.Fatal(err1)
+			}
+		}
 
-		queueSub := pubsub.NewSubscription(qs, &batcher.Options{
-			MaxBatchSize: 100,
-			MaxHandlers:  10, // max concurrency for receives
-		}, nil)
-		defer queueSub.Shutdown(ctx)
+		if len(received) == 1 {
+			time.Sleep(1500 * time.Millisecond)
+
+			// Parked messages report progress, so none of them is up for redelivery to another pull.
+			consumer, err1 := js.Consumer(ctx, opts.SetupOpts.StreamName, opts.SetupOpts.DurableQueue)
+			if err1 != nil {
+				t.Fatal(err1)
+			}
+			batch, err1 := consumer.Fetch(count, jetstream.FetchMaxWait(300*time.Millisecond))
+			if err1 != nil {
+				t.Fatal(err1)
+			}
+			for msg := range batch.Messages() {
+				t.Fatalf("Expected the parked messages to be kept alive, %q was redelivered", msg.Data())
+			}
+		}
+	}
+}
+
+func TestPlainReceiveReturnsWithoutWaitingForFullBatch(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	opts := defaultSubOptions("empty", t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 10000
+
+	ds, err := openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	msgs, err := ds.ReceiveBatch(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("Expected no messages, got %d", len(msgs))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected receive on an empty subject to return within about a second, took %v", elapsed)
+	}
+
+	natsConn := conn.Raw().(*nats.Conn)
+	for i := 0; i < 3; i++ {
+		if err = natsConn.Publish("empty", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = natsConn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := 0
+	for received < 3 {
+		msgs, err = ds.ReceiveBatch(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += len(msgs)
+	}
+}
+
+func TestPlainDroppedMessages(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	opts := defaultSubOptions("slow", t.Name())
+	opts.ConsumerPendingMsgsLimit = 1
+
+	ds, err := openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queue connections.Queue
+	if !ds.As(&queue) {
+		t.Fatal("Expected subscription to expose its queue")
+	}
+	defer queue.Unsubscribe()
+
+	counter, ok := queue.(connections.DroppedCounter)
+	if !ok {
+		t.Fatal("Expected plain queue to report dropped messages")
+	}
+
+	// Nothing is received, so the internal buffer fills up and the pending limit is exceeded.
+	natsConn := conn.Raw().(*nats.Conn)
+	for i := 0; i < 2000; i++ {
+		if err = natsConn.Publish("slow", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = natsConn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dropped, err := counter.Dropped()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected messages to be dropped once the pending limit is exceeded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestReceiveRespectsContext(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		newHarness drivertest.HarnessMaker
+	}{
+		{"Plain", newPlainHarness},
+		{"Jetstream", newJetstreamHarness},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dh, err := test.newHarness(ctx, t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dh.Close()
+			conn := dh.(*harness).conn
+
+			subject := sanitizeName(t.Name())
+			opts := defaultSubOptions(subject, t.Name())
+			opts.ConsumerMaxBatchTimeoutMs = 10000
+
+			ds, err := openSubscription(ctx, conn, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cancelCtx, cancel := context.WithCancel(ctx)
+			time.AfterFunc(100*time.Millisecond, cancel)
+
+			start := time.Now()
+			_, err = ds.ReceiveBatch(cancelCtx, 10)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected %v, got %v", context.Canceled, err)
+			}
+			if gce := ds.ErrorCode(err); gce != gcerrors.Canceled {
+				t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("Expected receive to stop once cancelled, took %v", elapsed)
+			}
+
+			// Shutting down cancels any receive in progress instead of waiting out the batch timeout.
+			opts = defaultSubOptions(subject, t.Name())
+			opts.ConsumerMaxBatchTimeoutMs = 10000
+			opts.SetupOpts.DurableQueue = "shutdown"
+
+			ps, err := OpenSubscription(ctx, conn, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go func() { _, _ = ps.Receive(ctx) }()
+			time.Sleep(100 * time.Millisecond)
+
+			start = time.Now()
+			_ = ps.Shutdown(ctx)
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("Expected shutdown to finish well under the batch timeout, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestJetstreamCancelledReceiveHandsBackLateMessages(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	subject := sanitizeName(t.Name())
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 2000
+	opts.SetupOpts.ConsumerAckWait = time.Minute
+
+	queue, err := h.conn.CreateSubscription(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Unsubscribe()
+
+	// The abandoned pull is still open on the server and takes this message, it has to be handed back
+	// once the pull ends rather than wait out the ack wait of a minute.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err = queue.ReceiveMessages(cancelCtx, 10); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	js, err := jetstream.New(h.nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.Publish(ctx, subject, []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for {
+		msgs, err := queue.ReceiveMessages(receiveCtx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) > 0 {
+			return
+		}
+	}
+}
+
+func TestJetstreamAckModes(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		ackMode connections.AckMode
+	}{
+		{"Sync", connections.AckSync},
+		{"FireAndForget", connections.AckFireAndForget},
+		{"Async", connections.AckAsync},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dh, err := newJetstreamHarness(ctx, t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dh.Close()
+			h := dh.(*harness)
+			conn := h.conn
+
+			subject := sanitizeName(t.Name())
+			opts := defaultSubOptions(subject, t.Name())
+			opts.AckMode = test.ackMode
+
+			ds, err := openSubscription(ctx, conn, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			js := conn.Raw().(jetstream.JetStream)
+			for i := 0; i < 3; i++ {
+				if _, err = js.Publish(ctx, subject, []byte(strconv.Itoa(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var dms []*driver.Message
+			for len(dms) < 3 {
+				msgs, err := ds.ReceiveBatch(ctx, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dms = append(dms, msgs...)
+			}
+
+			// Acknowledging twice succeeds, ids of another type are skipped and counted.
+			ids := []driver.AckID{dms[0].AckID, dms[1].AckID, "not a message"}
+			for i := 0; i < 2; i++ {
+				if err = ds.SendAcks(ctx, ids); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var queue connections.Queue
+			ds.As(&queue)
+			if skipped := queue.(connections.SkippedCounter).Skipped(); skipped != 2 {
+				t.Fatalf("Expected 2 skipped ack ids, got %d", skipped)
+			}
+
+			// Acknowledgements that can not reach the server are reported.
+			h.nc.Close()
+			err = ds.SendAcks(ctx, []driver.AckID{dms[2].AckID})
+			if test.ackMode == connections.AckAsync {
+				if err != nil {
+					t.Fatalf("Expected async ack failures to be reported by the following call, got %v", err)
+				}
+				time.Sleep(100 * time.Millisecond)
+				err = ds.SendAcks(ctx, nil)
+			}
+			if err == nil {
+				t.Fatal("Expected an error when acknowledging over a closed connection")
+			}
+			if gce := ds.ErrorCode(err); gce != gcerrors.FailedPrecondition {
+				t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+			}
+		})
+	}
+}
+
+func TestJetstreamAsyncAcksBoundToSubscription(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	subject := sanitizeName(t.Name())
+	opts := defaultSubOptions(subject, t.Name())
+	opts.AckMode = connections.AckAsync
+
+	goroutines := connectionGoroutines()
+	ps, err := OpenSubscription(ctx, h.conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queue connections.Queue
+	if !ps.As(&queue) {
+		t.Fatal("Expected the subscription to expose its queue")
+	}
+
+	js := h.conn.Raw().(jetstream.JetStream)
+	const count = 200
+	for i := 0; i < count; i++ {
+		if _, err = js.Publish(ctx, subject, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []driver.AckID
+	for len(ids) < count {
+		msgs, err := queue.ReceiveMessages(ctx, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			ids = append(ids, m.AckID)
+		}
+	}
+
+	// A burst of acks is confirmed by the workers of the subscription rather than a goroutine each.
+	running := runtime.NumGoroutine()
+	if err = queue.Ack(ctx, ids[:count-1]); err != nil {
+		t.Fatal(err)
+	}
+	if started := runtime.NumGoroutine() - running; started > 0 {
+		t.Errorf("Expected acks to reuse the workers of the subscription, %d goroutines were started", started)
+	}
+
+	// Shutting the subscription down stops the workers, later acks are still sent.
+	if err = ps.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); connectionGoroutines() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left := connectionGoroutines() - goroutines; left > 0 {
+		t.Errorf("Expected shutdown to stop the workers, %d goroutines are left", left)
+	}
+	if err = queue.Ack(ctx, ids[count-1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	consumer, err := js.Consumer(ctx, opts.SetupOpts.StreamName, opts.SetupOpts.DurableQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := consumer.Info(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.NumAckPending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every message to be acknowledged, %d are pending", info.NumAckPending)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPlainNackNotSupported(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	ds, err := openSubscription(ctx, conn, defaultSubOptions("nack", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.SendNacks(ctx, []driver.AckID{&nats.Msg{Subject: "nack"}})
+	if !errors.Is(err, connections.ErrNackNotSupported) {
+		t.Fatalf("Expected %v, got %v", connections.ErrNackNotSupported, err)
+	}
+	if gce := ds.ErrorCode(err); gce != gcerrors.Unimplemented {
+		t.Fatalf("Expected %v, got %v", gcerrors.Unimplemented, gce)
+	}
+}
+
+func TestRedeliveryPolicies(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       connections.RedeliveryPolicy
+		numDelivered uint64
+		want         time.Duration
+	}{
+		{"fixed", connections.FixedRedeliveryPolicy{Interval: time.Second}, 4, time.Second},
+		{"exponential first", connections.ExponentialRedeliveryPolicy{Initial: time.Second, Multiplier: 2}, 1, time.Second},
+		{"exponential third", connections.ExponentialRedeliveryPolicy{Initial: time.Second, Multiplier: 2}, 3, 4 * time.Second},
+		{"exponential capped", connections.ExponentialRedeliveryPolicy{Initial: time.Second, Max: 3 * time.Second, Multiplier: 2}, 5, 3 * time.Second},
+		{"exponential uncapped", connections.ExponentialRedeliveryPolicy{Initial: time.Second, Multiplier: 2}, 100, math.MaxInt64},
+		{"exponential uncapped overflow", connections.ExponentialRedeliveryPolicy{Initial: time.Second, Multiplier: 2}, 5000, math.MaxInt64},
+		{"exponential without initial", connections.ExponentialRedeliveryPolicy{Multiplier: 2}, 5000, 0},
+		{"table", connections.TableRedeliveryPolicy{Delays: []time.Duration{time.Second, time.Minute}}, 2, time.Minute},
+		{"table exhausted", connections.TableRedeliveryPolicy{Delays: []time.Duration{time.Second, time.Minute}}, 7, time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.Delay(test.numDelivered); got != test.want {
+			t.Errorf("%s: got delay %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	jittered := connections.ExponentialRedeliveryPolicy{Initial: time.Second, Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := jittered.Delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %v out of bounds", got)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := jittered.Delay(5000); got < math.MaxInt64/2 {
+			t.Fatalf("jittered delay %v of an overflowing wait out of bounds", got)
+		}
+	}
+}
+
+func TestJetstreamNackWithDelay(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "delayed"
+	const delay = 500 * time.Millisecond
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.RedeliveryPolicy = connections.FixedRedeliveryPolicy{Interval: delay}
+
+	ds, err := openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js := conn.Raw().(jetstream.JetStream)
+	if _, err = js.Publish(ctx, subject, []byte("retry")); err != nil {
+		t.Fatal(err)
+	}
+
+	var dms []*driver.Message
+	for len(dms) == 0 {
+		if dms, err = ds.ReceiveBatch(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nackedAt := time.Now()
+	if err = ds.SendNacks(ctx, []driver.AckID{dms[0].AckID}); err != nil {
+		t.Fatal(err)
+	}
+
+	for dms = nil; len(dms) == 0; {
+		if dms, err = ds.ReceiveBatch(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(nackedAt); elapsed < delay {
+		t.Fatalf("Expected redelivery after %v, got it after %v", delay, elapsed)
+	}
+}
+
+func TestJetstreamLeaseExtension(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "leased"
+	const ackWait = time.Second
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 500
+	opts.SetupOpts.ConsumerAckWait = ackWait
+	opts.LeaseRenewalFraction = 0.5
+
+	ds, err := openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js := conn.Raw().(jetstream.JetStream)
+	if _, err = js.Publish(ctx, subject, []byte("long running")); err != nil {
+		t.Fatal(err)
+	}
+
+	var dms []*driver.Message
+	for len(dms) == 0 {
+		if dms, err = ds.ReceiveBatch(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The handler holds on to the message for well over the ack wait, it should not be redelivered.
+	deadline := time.Now().Add(3 * ackWait)
+	for time.Now().Before(deadline) {
+		redelivered, err := ds.ReceiveBatch(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(redelivered) > 0 {
+			t.Fatal("Expected the leased message not to be redelivered")
+		}
+	}
+
+	// Once the subscription is closed its leases are no longer extended, so the message is redelivered.
+	if err = ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err = openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 5*ackWait)
+	defer cancel()
+	for dms = nil; len(dms) == 0; {
+		if dms, err = ds.ReceiveBatch(receiveCtx, 1); err != nil {
+			t.Fatalf("Expected the message to be redelivered once the subscription closed, got %v", err)
+		}
+	}
+
+	if err = ds.SendAcks(ctx, []driver.AckID{dms[0].AckID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJetstreamInvalidLeaseFraction(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	for _, fraction := range []float64{-0.5, 1, 2} {
+		opts := defaultSubOptions("leased", t.Name())
+		opts.LeaseRenewalFraction = fraction
+		if _, err = conn.CreateSubscription(ctx, opts); !errors.Is(err, connections.ErrInvalidLeaseFraction) {
+			t.Errorf("Expected fraction %v to be rejected with %v, got %v", fraction, connections.ErrInvalidLeaseFraction, err)
+		}
+	}
+}
+
+func TestJetstreamTerminate(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "poison"
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 500
+	opts.SetupOpts.ConsumerAckWait = 500 * time.Millisecond
+	opts.TerminateUndecodable = true
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	js := conn.Raw().(jetstream.JetStream)
+
+	// A header that is not query escaped can not be decoded and is terminated on receipt.
+	undecodable := nats.NewMsg(subject)
+	undecodable.Header.Set("bad", "%zz")
+	undecodable.Data = []byte("undecodable")
+	if _, err = js.PublishMsg(ctx, undecodable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.Publish(ctx, subject, []byte("poison")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != "poison" {
+		t.Fatalf("Expected the undecodable message to be skipped, got %q", msg.Body)
+	}
+	if err = Terminate(msg, "can never succeed"); err != nil {
+		t.Fatal(err)
+	}
+
+	var queue connections.Queue
+	ps.As(&queue)
+	if terminated := queue.(connections.TerminatedCounter).Terminated(); terminated != 2 {
+		t.Fatalf("Expected 2 terminated messages, got %d", terminated)
+	}
+
+	// Neither message is redelivered once the ack wait has passed.
+	receiveCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if msg, err = ps.Receive(receiveCtx); err == nil {
+		t.Fatalf("Expected no redelivery of terminated messages, got %q", msg.Body)
+	}
+}
+
+func TestPlainTerminateNotSupported(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	ps, err := OpenSubscription(ctx, h.conn, defaultSubOptions("terminate", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	if err = h.nc.Publish("terminate", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+
+	if err = Terminate(msg, "reason"); !errors.Is(err, errTerminateNotSupported) {
+		t.Fatalf("Expected %v, got %v", errTerminateNotSupported, err)
+	}
+}
+
+func TestJetstreamShutdownStopsSubscription(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+	js := conn.Raw().(jetstream.JetStream)
+
+	subject := sanitizeName(t.Name())
+	opts := defaultSubOptions(subject, t.Name())
+	opts.SetupOpts.DurableQueue = ""
+	opts.SetupOpts.ConsumerMaxDeliver = 2
+	opts.DeadLetterSubject = subject + "_dead"
+	opts.AckMode = connections.AckAsync
+
+	advisoryStreams := func() []string {
+		var names []string
+		lister := js.StreamNames(ctx)
+		for name := range lister.Name() {
+			if strings.HasSuffix(name, "_advisories") {
+				names = append(names, name)
+			}
+		}
+		if err0 := lister.Err(); err0 != nil {
+			t.Fatal(err0)
+		}
+		return names
+	}
+
+	// Subscriptions left open by earlier tests run work of their own.
+	goroutines := connectionGoroutines()
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connectionGoroutines() <= goroutines {
+		t.Fatal("Expected the subscription to run background work")
+	}
+	if names := advisoryStreams(); len(names) != 1 {
+		t.Fatalf("Expected the ephemeral consumer to have an advisory stream, got %v", names)
+	}
+
+	if err = ps.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The advisory stream of an ephemeral consumer is named after it, so one left behind would never be used again.
+	if names := advisoryStreams(); len(names) != 0 {
+		t.Fatalf("Expected the advisory stream to be removed on shutdown, got %v", names)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for connectionGoroutines() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left := connectionGoroutines() - goroutines; left > 0 {
+		t.Fatalf("Expected shutdown to stop the background work, %d goroutines are left", left)
+	}
+}
+
+// connectionGoroutines counts the goroutines running code of the connections package,
+// those of the embedded server and the nats client are left out.
+func connectionGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	count := 0
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(stack, "natspubsub/connections.") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestJetstreamDeadLetterAfterMaxDeliveries(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "shop/orders"
+	const dlqSubject = "orders_dead"
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 200
+	opts.SetupOpts.ConsumerMaxDeliver = 2
+	opts.DeadLetterSubject = dlqSubject
+
+	// The dead letter subject can not be stored by the stream messages are dead lettered from.
+	looping := defaultSubOptions(subject, t.Name()+"_looping")
+	looping.SetupOpts.Subjects = []string{"looping", "looping_dead"}
+	looping.DeadLetterSubject = "looping_dead"
+	if _, err = conn.CreateSubscription(ctx, looping); !errors.Is(err, connections.ErrDeadLetterSubjectInSourceStream) {
+		t.Fatalf("Expected %v, got %v", connections.ErrDeadLetterSubjectInSourceStream, err)
+	}
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("unprocessable"), Metadata: map[string]string{"origin": "test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		msg, err0 := ps.Receive(ctx)
+		if err0 != nil {
+			t.Fatal(err0)
+		}
+		msg.Nack()
+	}
+
+	// Keep pulling so the server notices the delivery limit was reached.
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if msg, err0 := ps.Receive(receiveCtx); err0 == nil {
+		t.Fatalf("Expected no delivery beyond the limit, got %q", msg.Body)
+	}
+
+	js := conn.Raw().(jetstream.JetStream)
+	streamName, err := js.StreamNameBySubject(ctx, dlqSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dead *jetstream.RawStreamMsg
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if dead, err = stream.GetMsg(ctx, 1); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Expected the message to be dead lettered, got %v", err)
+	}
+
+	if string(dead.Data) != "unprocessable" {
+		t.Fatalf("Expected the original body, got %q", dead.Data)
+	}
+	expected := map[string]string{
+		"origin":                               "test",
+		connections.HeaderDeadLetterStream:     opts.SetupOpts.StreamName,
+		connections.HeaderDeadLetterSequence:   "1",
+		connections.HeaderDeadLetterSubject:    subject,
+		connections.HeaderDeadLetterDeliveries: "2",
+		connections.HeaderDeadLetterLastError:  "natspubsub: message was negatively acknowledged",
+	}
+	for k, v := range expected {
+		if got := dead.Header.Get(k); got != v {
+			t.Errorf("Expected header %s to be %q, got %q", k, v, got)
+		}
+	}
+}
+
+func TestJetstreamDeadLetterRetriesWithDelay(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+	js := conn.Raw().(jetstream.JetStream)
+
+	subject := sanitizeName(t.Name())
+
+	var reportsMutex sync.Mutex
+	var reports []error
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 200
+	opts.SetupOpts.ConsumerMaxDeliver = 1
+	opts.DeadLetterSubject = subject + "_dead"
+	opts.ErrorHandler = func(err error) {
+		reportsMutex.Lock()
+		defer reportsMutex.Unlock()
+		reports = append(reports, err)
+	}
+
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	// Without a stream storing the dead letter subject every attempt to dead letter the message fails.
+	if err = js.DeleteStream(ctx, opts.SetupOpts.StreamName+"_dlq"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = js.Publish(ctx, subject, []byte("unprocessable")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Nack()
+
+	// Keep pulling so the server notices the delivery limit was reached.
+	receiveCtx, cancel := context.WithTimeout(ctx, 2500*time.Millisecond)
+	defer cancel()
+	if msg, err = ps.Receive(receiveCtx); err == nil {
+		t.Fatalf("Expected no delivery beyond the limit, got %q", msg.Body)
+	}
+
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	if len(reports) == 0 {
+		t.Fatal("Expected the failed dead lettering to be reported")
+	}
+	if len(reports) > 3 {
+		t.Fatalf("Expected failed dead lettering to be retried with a delay, it failed %d times : %v", len(reports), reports[0])
+	}
+}
+
+func TestPlainAcknowledgedDelivery(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "acknowledged"
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.Acknowledged = true
+	ds, err := openSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.CanNack() {
+		t.Fatal("Expected an acknowledged subscription to support nacks")
+	}
+	ps := pubsub.NewSubscription(ds, nil, nil)
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject, Acknowledged: true, AckTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pt.Send(ctx, &pubsub.Message{Body: []byte("at least once")})
+	}()
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Nack()
+
+	msg, err = ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Body) != "at least once" {
+		t.Fatalf("Expected the nacked message to be published again, got %q", msg.Body)
+	}
+	msg.Ack()
+
+	select {
+	case err = <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the send to return once the message was acknowledged")
+	}
+}
+
+func TestPlainAcknowledgedNotAcknowledged(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	ds, err := openSubscription(ctx, conn, defaultSubOptions("unacknowledged", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.CanNack() {
+		t.Fatal("Expected a plain subscription without acknowledgements to not support nacks")
+	}
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{
+		Subject:        "unacknowledged",
+		Acknowledged:   true,
+		AckTimeout:     100 * time.Millisecond,
+		MaxAckAttempts: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	// The subscriber never answers, so every attempt times out.
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("lost")})
+	if !errors.Is(err, connections.ErrNotAcknowledged) {
+		t.Fatalf("Expected %v, got %v", connections.ErrNotAcknowledged, err)
+	}
+}
+
+func TestJetstreamAsyncPublish(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "async"
+	const count = 50
+
+	ps, err := OpenSubscription(ctx, conn, defaultSubOptions(subject, t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject, MaxPendingPublishes: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			errs <- pt.Send(ctx, &pubsub.Message{Body: []byte(strconv.Itoa(i))})
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := map[string]bool{}
+	for len(received) < count {
+		msg, err0 := ps.Receive(ctx)
+		if err0 != nil {
+			t.Fatal(err0)
+		}
+		msg.Ack()
+		received[string(msg.Body)] = true
+	}
+}
+
+func TestJetstreamBatchPublishReportsFailures(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	tests := []struct {
+		name string
+		opts connections.TopicOptions
+	}{
+		{"async", connections.TopicOptions{MaxPendingPublishes: 2, AsyncPublishRetries: 1}},
+		{"concurrent", connections.TopicOptions{PublishConcurrency: 2}},
+		{"serial", connections.TopicOptions{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// No stream stores the subject, so every publish fails.
+			opts := test.opts
+			opts.Subject = "unstored"
+			dt, err := openTopic(ctx, conn, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sent := 0
+			var published []*nats.Msg
+			msgs := []*driver.Message{{Body: []byte("a")}, {Body: []byte("b")}, {Body: []byte("c")}}
+			for _, m := range msgs {
+				m.BeforeSend = func(as func(interface{}) bool) error {
+					var msg *nats.Msg
+					if as(&msg) {
+						published = append(published, msg)
+					}
+					return nil
+				}
+				m.AfterSend = func(func(interface{}) bool) error {
+					sent++
+					return nil
+				}
+			}
+
+			err = dt.SendBatch(ctx, msgs)
+
+			var batchErr *connections.PublishBatchError
+			if !dt.ErrorAs(err, &batchErr) {
+				t.Fatalf("Expected a %T, got %v", batchErr, err)
+			}
+			if len(batchErr.Failed) != len(msgs) {
+				t.Fatalf("Expected %d failed messages, got %d : %v", len(msgs), len(batchErr.Failed), batchErr)
+			}
+			if sent != 0 {
+				t.Fatalf("Expected AfterSend to be skipped for failed messages, it ran %d times", sent)
+			}
+
+			// Retried messages carry a message id, so the stream drops any it stored already.
+			if opts.AsyncPublishRetries > 0 {
+				ids := map[string]bool{}
+				for _, msg := range published {
+					ids[msg.Header.Get(jetstream.MsgIDHeader)] = true
+				}
+				if len(ids) != len(msgs) || ids[""] {
+					t.Fatalf("Expected every retried message to have an id of its own, got %v", ids)
+				}
+			}
+		})
+	}
+}
+
+func TestPlainConcurrentPublish(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	const subject = "concurrent"
+	const count = 40
+	const concurrency = 4
+
+	// Acknowledged publishes wait for a reply, the subscriber holds back its replies until as many publishes
+	// as the concurrency allows are waiting at once. Publishes sent one at a time are released after a pause instead.
+	requests := make(chan *nats.Msg, count)
+	nsub, err := h.nc.ChanSubscribe(subject, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nsub.Unsubscribe()
+
+	received := map[string]bool{}
+	maxInFlight := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var held []*nats.Msg
+		release := func() {
+			for _, msg := range held {
+				_ = msg.Respond([]byte("+ACK"))
+			}
+			held = held[:0]
+		}
+
+		for len(received) < count {
+			select {
+			case msg := <-requests:
+				received[string(msg.Data)] = true
+				held = append(held, msg)
+				if len(held) > maxInFlight {
+					maxInFlight = len(held)
+				}
+				if len(held) == concurrency {
+					release()
+				}
+			case <-time.After(200 * time.Millisecond):
+				release()
+			}
+		}
+		release()
+	}()
+
+	pt, err := OpenTopic(ctx, h.conn, &connections.TopicOptions{
+		Subject:            subject,
+		Acknowledged:       true,
+		MaxBatchSize:       10,
+		MaxHandlers:        1,
+		PublishConcurrency: concurrency,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			errs <- pt.Send(ctx, &pubsub.Message{Body: []byte(strconv.Itoa(i))})
+		}(i)
+	}
+	for i := 0; i < count; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	if len(received) != count {
+		t.Fatalf("Expected %d messages, got %d", count, len(received))
+	}
+	if maxInFlight != concurrency {
+		t.Fatalf("Expected %d publishes of a batch to wait for their acknowledgement at once, got %d", concurrency, maxInFlight)
+	}
+}
+
+func TestJetstreamPublishDeduplication(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+	js := conn.Raw().(jetstream.JetStream)
+
+	tests := []struct {
+		name   string
+		opts   connections.TopicOptions
+		first  *driver.Message
+		second *driver.Message
+		want   bool
+	}{
+		{
+			name:   "metadata",
+			opts:   connections.TopicOptions{MessageIDSource: connections.MessageIDFromMetadata, MessageIDMetadataKey: "order"},
+			first:  &driver.Message{Body: []byte("placed"), Metadata: map[string]string{"order": "1"}},
+			second: &driver.Message{Body: []byte("placed again"), Metadata: map[string]string{"order": "1"}},
+			want:   true,
+		},
+		{
+			name:   "content hash",
+			opts:   connections.TopicOptions{MessageIDSource: connections.MessageIDFromContentHash},
+			first:  &driver.Message{Body: []byte("placed"), Metadata: map[string]string{"a": "1", "b": "2"}},
+			second: &driver.Message{Body: []byte("placed"), Metadata: map[string]string{"b": "2", "a": "1"}},
+			want:   true,
+		},
+		{
+			name:   "content hash differs",
+			opts:   connections.TopicOptions{MessageIDSource: connections.MessageIDFromContentHash},
+			first:  &driver.Message{Body: []byte("placed")},
+			second: &driver.Message{Body: []byte("cancelled")},
+			want:   false,
+		},
+		{
+			name:   "no id",
+			opts:   connections.TopicOptions{},
+			first:  &driver.Message{Body: []byte("placed")},
+			second: &driver.Message{Body: []byte("placed")},
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subject := sanitizeName(t.Name())
+			_, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: subject, Subjects: []string{subject}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := test.opts
+			opts.Subject = subject
+			dt, err := openTopic(ctx, conn, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var acks []*jetstream.PubAck
+			for _, m := range []*driver.Message{test.first, test.second} {
+				m.AfterSend = func(as func(interface{}) bool) error {
+					var ack *jetstream.PubAck
+					if !as(&ack) {
+						return fmt.Errorf("cast failed for %T", &ack)
+					}
+					acks = append(acks, ack)
+					return nil
+				}
+				if err = dt.SendBatch(ctx, []*driver.Message{m}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if acks[0].Duplicate {
+				t.Fatal("Expected the first message to be stored")
+			}
+			if acks[1].Duplicate != test.want {
+				t.Fatalf("Expected duplicate %v for the second message, got %v", test.want, acks[1].Duplicate)
+			}
+		})
+	}
+}
+
+func TestJetstreamPublishExpectations(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+	js := conn.Raw().(jetstream.JetStream)
+
+	const subject = "aggregate"
+	const streamName = "aggregates"
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{Name: streamName, Subjects: []string{subject}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     gcerrors.ErrorCode
+	}{
+		{"append to empty stream", map[string]string{MetadataExpectedLastSequence: "0", jetstream.MsgIDHeader: "event:1"}, gcerrors.OK},
+		{"stale sequence", map[string]string{MetadataExpectedLastSequence: "0"}, gcerrors.FailedPrecondition},
+		{"current sequence", map[string]string{MetadataExpectedLastSequence: "1"}, gcerrors.OK},
+		{"stale subject sequence", map[string]string{MetadataExpectedLastSubjectSequence: "1"}, gcerrors.FailedPrecondition},
+		{"current subject sequence", map[string]string{MetadataExpectedLastSubjectSequence: "2"}, gcerrors.OK},
+		{"stale message id", map[string]string{MetadataExpectedLastMsgID: "event:1"}, gcerrors.FailedPrecondition},
+		{"other stream", map[string]string{MetadataExpectedStream: "other"}, gcerrors.FailedPrecondition},
+		{"same stream", map[string]string{MetadataExpectedStream: streamName}, gcerrors.OK},
+	}
+
+	for _, test := range tests {
+		err = pt.Send(ctx, &pubsub.Message{Body: []byte(test.name), Metadata: test.metadata})
+		if got := gcerrors.Code(err); got != test.want {
+			t.Errorf("%s: got error code %v, want %v : %v", test.name, got, test.want, err)
+		}
+	}
+}
+
+func TestPlainFlushOnSend(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort), nats.ReconnectBufSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	conn := connections.NewPlain(nc)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{
+		Subject:      "audit",
+		FlushOnSend:  true,
+		FlushTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	if err = pt.Send(ctx, &pubsub.Message{Body: []byte("received")}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.s.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); !nc.IsReconnecting() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The client buffers the message while reconnecting, but the server never confirms it.
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("buffered")})
+	if !errors.Is(err, connections.ErrFlushFailed) {
+		t.Fatalf("Expected %v, got %v", connections.ErrFlushFailed, err)
+	}
+
+	// Once the reconnect buffer is full every further message is rejected by the client.
+	large := bytes.Repeat([]byte("x"), 128)
+	_ = pt.Send(ctx, &pubsub.Message{Body: large})
+	err = pt.Send(ctx, &pubsub.Message{Body: large})
+	if !errors.Is(err, nats.ErrReconnectBufExceeded) {
+		t.Fatalf("Expected %v, got %v", nats.ErrReconnectBufExceeded, err)
+	}
+	if code := gcerrors.Code(err); code != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, code)
+	}
+}
+
+func TestPlainFlushOnSendReportsRefusedPublishes(t *testing.T) {
+	ctx := context.Background()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	opts.Users = []*server.User{{
+		Username:    "publisher",
+		Password:    "secret",
+		Permissions: &server.Permissions{Publish: &server.SubjectPermission{Allow: []string{"audit"}}},
+	}}
+	s := gnatsd.RunServer(&opts)
+	defer s.Shutdown()
+
+	// The error handler set before the connection is wrapped keeps being called.
+	handled := make(chan error, 10)
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort), nats.UserInfo("publisher", "secret"),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			select {
+			case handled <- err:
+			default:
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	conn := connections.NewPlain(nc)
+
+	refused, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: "payroll", FlushOnSend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Shutdown(ctx)
+
+	allowed, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: "audit", FlushOnSend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Shutdown(ctx)
+
+	err = refused.Send(ctx, &pubsub.Message{Body: []byte("refused")})
+	if !errors.Is(err, connections.ErrFlushFailed) || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Fatalf("Expected the refused publish to fail with %v, got %v", connections.ErrFlushFailed, err)
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the error handler of the connection to be called")
+	}
+
+	// The error of the earlier publish is not reported again.
+	if err = allowed.Send(ctx, &pubsub.Message{Body: []byte("allowed")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refusal fails only the batches publishing to the refused subject, even while others flush on the connection.
+	var refusedTopic, allowedTopic connections.Topic
+	if !refused.As(&refusedTopic) || !allowed.As(&allowedTopic) {
+		t.Fatal("Expected the topics to expose their connection topics")
+	}
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, 2)
+		for i, topic := range []connections.Topic{refusedTopic, allowedTopic} {
+			wg.Add(1)
+			go func(i int, topic connections.Topic) {
+				defer wg.Done()
+				<-start
+				_, errs[i] = topic.(connections.BatchPublisher).PublishMessages(ctx, []*nats.Msg{nats.NewMsg(topic.Subject())})
+			}(i, topic)
+		}
+		close(start)
+		wg.Wait()
+
+		if !errors.Is(errs[0], connections.ErrFlushFailed) {
+			t.Fatalf("Expected the refused batch to fail with %v, got %v", connections.ErrFlushFailed, errs[0])
+		}
+		if errs[1] != nil {
+			t.Fatalf("Expected the allowed batch to be published, got %v", errs[1])
+		}
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		newHarness func(context.Context, *testing.T) (drivertest.Harness, error)
+	}{
+		{"Plain", newPlainHarness},
+		{"Jetstream", newJetstreamHarness},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dh, err := test.newHarness(ctx, t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dh.Close()
+			conn := dh.(*harness).conn
+
+			const subject = "rpc"
+
+			ps, err := OpenSubscription(ctx, conn, defaultSubOptions(subject, t.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ps.Shutdown(ctx)
+
+			pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pt.Shutdown(ctx)
+
+			responded := make(chan error, 1)
+			go func() {
+				msg, err := ps.Receive(ctx)
+				if err != nil {
+					responded <- err
+					return
+				}
+				msg.Ack()
+				reply := &pubsub.Message{
+					Body:     bytes.ToUpper(msg.Body),
+					Metadata: map[string]string{"request id": msg.Metadata["request id"]},
+				}
+				responded <- Respond(ctx, msg, reply)
+			}()
+
+			requestCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			reply, err := Request(requestCtx, pt, &pubsub.Message{Body: []byte("ping"), Metadata: map[string]string{"request id": "1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = <-responded; err != nil {
+				t.Fatal(err)
+			}
+
+			if string(reply.Body) != "PING" || reply.Metadata["request id"] != "1" {
+				t.Fatalf("Unexpected reply %q with metadata %v", reply.Body, reply.Metadata)
+			}
+		})
+	}
+}
+
+func TestPlainGather(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "inventory"
+	const responders = 3
+
+	for i := 0; i < responders; i++ {
+		opts := defaultSubOptions(subject, t.Name())
+		opts.SetupOpts.DurableQueue = ""
+		ps, err := OpenSubscription(ctx, conn, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ps.Shutdown(ctx)
+
+		go func(i int, ps *pubsub.Subscription) {
+			for {
+				msg, err := ps.Receive(ctx)
+				if err != nil {
+					return
+				}
+				msg.Ack()
+				_ = Respond(ctx, msg, &pubsub.Message{Body: []byte(strconv.Itoa(i))})
+			}
+		}(i, ps)
+	}
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	countCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	replies, err := Gather(countCtx, pt, &pubsub.Message{Body: []byte("stock?")}, responders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != responders {
+		t.Fatalf("Expected %d replies, got %d", responders, len(replies))
+	}
+
+	// Without a count replies are gathered until the context is done.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	replies, err = Gather(timeoutCtx, pt, &pubsub.Message{Body: []byte("stock?")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != responders {
+		t.Fatalf("Expected %d replies, got %d", responders, len(replies))
+	}
+}
+
+func TestRespondOnlyToRequests(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	const subject = "notifications"
+
+	ps, err := OpenSubscription(ctx, h.conn, defaultSubOptions(subject, t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, h.conn, &connections.TopicOptions{Subject: subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	// Only Request can name the subject replies go to.
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("spoofed"), Metadata: map[string]string{connections.HeaderReplyTo: "elsewhere"}})
+	if code := gcerrors.Code(err); code != gcerrors.InvalidArgument {
+		t.Fatalf("Expected %v, got %v", gcerrors.InvalidArgument, err)
+	}
+
+	// Messages of other clients with a reply header of their own are not requests.
+	if err = pt.Send(ctx, &pubsub.Message{Body: []byte("mail"), Metadata: map[string]string{"Reply-To": "someone@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if err = Respond(ctx, msg, &pubsub.Message{Body: []byte("reply")}); !errors.Is(err, errRespondNotSupported) {
+		t.Fatalf("Expected %v, got %v", errRespondNotSupported, err)
+	}
+	if got := msg.Metadata["Reply-To"]; got != "someone@example.com" {
+		t.Fatalf("Expected the metadata to be kept, got %q", got)
+	}
+}
+
+func TestRequestNotSupported(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	js, err := jetstream.New(h.nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := connections.NewJetstream(js)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: "rpc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	_, err = Request(ctx, pt, &pubsub.Message{Body: []byte("ping")})
+	if !errors.Is(err, connections.ErrRequestNotSupported) {
+		t.Fatalf("Expected %v, got %v", connections.ErrRequestNotSupported, err)
+	}
+}
+
+func TestSubjectRouting(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	ps, err := OpenSubscription(ctx, conn, defaultSubOptions("orders.>", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: "orders", SubjectTemplate: "orders.{region}.{type}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	routed := map[string]string{
+		"eu.retail":    "orders.eu.retail",
+		"us.wholesale": "orders.us.wholesale",
+	}
+	for body := range routed {
+		region, kind, _ := strings.Cut(body, ".")
+		err = pt.Send(ctx, &pubsub.Message{Body: []byte(body), Metadata: map[string]string{"region": region, "type": kind}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range routed {
+		msg, err0 := ps.Receive(ctx)
+		if err0 != nil {
+			t.Fatal(err0)
+		}
+		msg.Ack()
+
+		var natsMsg *nats.Msg
+		if !msg.As(&natsMsg) {
+			t.Fatal("Expected the received message to be a nats message")
+		}
+		if want := routed[string(msg.Body)]; natsMsg.Subject != want {
+			t.Errorf("Expected %q to be published to %s, got %s", msg.Body, want, natsMsg.Subject)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"region": "eu"},
+		{"region": "eu", "type": ""},
+		{"region": "*", "type": "retail"},
+		{"region": "eu", "type": ">"},
+	}
+	for _, metadata := range invalid {
+		err = pt.Send(ctx, &pubsub.Message{Body: []byte("unroutable"), Metadata: metadata})
+		if code := gcerrors.Code(err); code != gcerrors.FailedPrecondition {
+			t.Errorf("%v: expected %v, got %v : %v", metadata, gcerrors.FailedPrecondition, code, err)
+		}
+	}
+
+	byFunc, err := OpenTopic(ctx, conn, &connections.TopicOptions{
+		Subject: "orders",
+		SubjectFunc: func(body []byte, metadata map[string]string) (string, error) {
+			return "orders.func." + string(body), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byFunc.Shutdown(ctx)
+
+	if err = byFunc.Send(ctx, &pubsub.Message{Body: []byte("routed")}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	var natsMsg *nats.Msg
+	if msg.As(&natsMsg); natsMsg.Subject != "orders.func.routed" {
+		t.Fatalf("Expected the subject returned by the func, got %s", natsMsg.Subject)
+	}
+
+	badTopics := []*connections.TopicOptions{
+		{Subject: "orders", SubjectTemplate: "orders.{region"},
+		{Subject: "orders", SubjectTemplate: "orders..{region}"},
+		{Subject: "orders", SubjectTemplate: "orders.*.{region}"},
+		{Subject: "orders", SubjectTemplate: "orders.{region}", SubjectFunc: func([]byte, map[string]string) (string, error) {
+			return "orders", nil
+		}},
+	}
+	for _, opts := range badTopics {
+		if _, err = openTopic(ctx, conn, opts); err == nil {
+			t.Errorf("Expected an error opening a topic with template %q", opts.SubjectTemplate)
+		}
+	}
+}
+
+// fakeClock is a connections.Clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestJetstreamScheduledDelivery(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "reminders"
+	const scheduleStream = "schedules"
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 200
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject, ScheduleStream: scheduleStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	// Messages not yet due are handed back to the server until their due time, so the clock runs alongside the real one.
+	clock := &fakeClock{now: time.Now()}
+	schedulers := make([]*connections.Scheduler, 2)
+	for i := range schedulers {
+		schedulers[i], err = connections.NewScheduler(ctx, conn, connections.SchedulerOptions{
+			Stream:       scheduleStream,
+			PollInterval: 100 * time.Millisecond,
+			Name:         fmt.Sprintf("scheduler-%d", i),
+			Clock:        clock,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader, follower := schedulers[0], schedulers[1]
+	defer func() { _ = follower.Close() }()
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("call back"), Metadata: map[string]string{
+		"origin":                      "test",
+		connections.MetadataDeliverAt: clock.Now().Add(time.Second).Format(time.RFC3339Nano),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered, err0 := leader.Tick(ctx); err0 != nil || delivered != 0 {
+		t.Fatalf("Expected nothing to be due yet, got %d delivered and error %v", delivered, err0)
+	}
+	if delivered, err0 := follower.Tick(ctx); err0 != nil || delivered != 0 {
+		t.Fatalf("Expected the follower to deliver nothing, got %d delivered and error %v", delivered, err0)
+	}
+	if !leader.IsLeader() || follower.IsLeader() {
+		t.Fatal("Expected exactly the first scheduler to lead")
+	}
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if msg, err0 := ps.Receive(receiveCtx); err0 == nil {
+		t.Fatalf("Expected no delivery before the due time, got %q", msg.Body)
+	}
+
+	clock.Advance(time.Second)
+
+	delivered := 0
+	for deadline := time.Now().Add(5 * time.Second); delivered == 0 && time.Now().Before(deadline); {
+		if delivered, err = leader.Tick(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered != 1 {
+		t.Fatalf("Expected the message to be delivered once due, got %d", delivered)
+	}
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if string(msg.Body) != "call back" || msg.Metadata["origin"] != "test" {
+		t.Fatalf("Expected the scheduled message, got %q with %v", msg.Body, msg.Metadata)
+	}
+	if _, ok := msg.Metadata[connections.MetadataDeliverAt]; ok {
+		t.Fatalf("Expected the scheduling metadata to be removed, got %v", msg.Metadata)
+	}
+
+	// The id ties the delivery to the scheduled message, so a delivery repeated by the next leader is dropped.
+	var header nats.Header
+	if !msg.As(&header) {
+		t.Fatalf("cast failed for %T", &header)
+	}
+	if got := header.Get(jetstream.MsgIDHeader); got != scheduleStream+"-1" {
+		t.Fatalf("Expected message id %q, got %q", scheduleStream+"-1", got)
+	}
+
+	if err = leader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = follower.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !follower.IsLeader() {
+		t.Fatal("Expected the follower to take over once the leader closed")
+	}
+}
+
+func TestJetstreamScheduledDeliveryKeepsEncodedMetadata(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	const subject = "reminders"
+	const scheduleStream = "schedules"
+
+	// Metadata with characters the default codec would unescape reaches the subscriber unchanged.
+	opts := defaultSubOptions(subject, t.Name())
+	opts.ConsumerMaxBatchTimeoutMs = 200
+	opts.HeaderCodec = connections.RawHeaderCodec{}
+	ps, err := OpenSubscription(ctx, conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{
+		Subject:        subject,
+		ScheduleStream: scheduleStream,
+		HeaderCodec:    connections.RawHeaderCodec{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	scheduler, err := connections.NewScheduler(ctx, conn, connections.SchedulerOptions{Stream: scheduleStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = scheduler.Close() }()
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("discount"), Metadata: map[string]string{
+		"rate":                        "100%",
+		connections.MetadataDeliverAt: time.Now().Format(time.RFC3339Nano),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := 0
+	for deadline := time.Now().Add(5 * time.Second); delivered == 0 && time.Now().Before(deadline); {
+		if delivered, err = scheduler.Tick(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered != 1 {
+		t.Fatalf("Expected the message to be delivered, got %d", delivered)
+	}
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if msg.Metadata["rate"] != "100%" {
+		t.Fatalf("Expected the metadata to be kept, got %v", msg.Metadata)
+	}
+}
+
+func TestJetstreamSchedulerReportsDroppedMessages(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	const scheduleStream = "schedules"
+
+	reported := make(chan error, 10)
+	scheduler, err := connections.NewScheduler(ctx, h.conn, connections.SchedulerOptions{
+		Stream:       scheduleStream,
+		PollInterval: 100 * time.Millisecond,
+		ErrorHandler: func(err error) { reported <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A message put in the schedule stream by hand has no due time, so it can never be delivered.
+	js := h.conn.Raw().(jetstream.JetStream)
+	if _, err = js.Publish(ctx, scheduleStream+".reminders", []byte("unscheduled")); err != nil {
+		t.Fatal(err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- scheduler.Run(runCtx) }()
+
+	select {
+	case err = <-reported:
+		if !errors.Is(err, connections.ErrInvalidDeliverAt) {
+			t.Fatalf("Expected %v to be reported, got %v", connections.ErrInvalidDeliverAt, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the dropped message to be reported")
+	}
+
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlainSchedulingNotSupported(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+
+	_, err = OpenTopic(ctx, dh.(*harness).conn, &connections.TopicOptions{Subject: "reminders", ScheduleStream: "schedules"})
+	if !errors.Is(err, connections.ErrSchedulingNotSupported) {
+		t.Fatalf("Expected %v, got %v", connections.ErrSchedulingNotSupported, err)
+	}
+}
+
+func TestJetstreamScheduledDeliveryInvalidTime(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: "reminders", ScheduleStream: "schedules"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("never"), Metadata: map[string]string{
+		connections.MetadataDeliverAt: "tomorrow",
+	}})
+	if !errors.Is(err, connections.ErrInvalidDeliverAt) {
+		t.Fatalf("Expected an invalid deliver-at error, got %v", err)
+	}
+}
+
+func TestJetstreamPublishRetryAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := gnatsd.RunServer(&opts)
+	defer func() { s.Shutdown() }()
+
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort),
+		nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	conn, err := connections.NewJetstreamFromConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const subject = "payments"
+	subOpts := defaultSubOptions(subject, t.Name())
+	subOpts.ConsumerMaxBatchTimeoutMs = 200
+	ps, err := OpenSubscription(ctx, conn, subOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, conn, &connections.TopicOptions{
+		Subject: subject,
+		PublishRetry: connections.PublishRetryPolicy{
+			Attempts:       20,
+			InitialBackoff: 50 * time.Millisecond,
+			MaxBackoff:     200 * time.Millisecond,
+			Jitter:         0.2,
+			AttemptTimeout: 250 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	s.Shutdown()
+	restarted := make(chan *server.Server, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		restarted <- gnatsd.RunServer(&opts)
+	}()
+
+	sendCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = pt.Send(sendCtx, &pubsub.Message{Body: []byte("charge")})
+	s = <-restarted
+	if err != nil {
+		t.Fatalf("Expected the publish to be retried until the server is back, got %v", err)
+	}
+
+	msg, err := ps.Receive(sendCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if string(msg.Body) != "charge" {
+		t.Fatalf("Expected the published message, got %q", msg.Body)
+	}
+
+	stream, err := conn.Raw().(jetstream.JetStream).Stream(ctx, subOpts.SetupOpts.StreamName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err0 := stream.Info(ctx); err0 != nil || info.State.Msgs != 1 {
+		t.Fatalf("Expected the retried message to be stored once, got %+v and error %v", info, err0)
+	}
+}
+
+func TestJetstreamPublishRetryRespectsDeadline(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	conn := dh.(*harness).conn
+
+	// No stream stores the subject, so every attempt fails as if the stream was electing a leader.
+	// The topic is used directly, as the portable topic publishes batches without the context of Send.
+	topic, err := conn.CreateTopic(ctx, &connections.TopicOptions{
+		Subject:      "unstored",
+		PublishRetry: connections.PublishRetryPolicy{Attempts: 1000, InitialBackoff: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = topic.PublishMessage(sendCtx, nats.NewMsg("unstored"))
+	if err == nil {
+		t.Fatal("Expected the publish to fail without a stream")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected retries to stop at the context deadline, took %v", elapsed)
+	}
+}
+
+func TestJetstreamOutboxRelaysStoredMessages(t *testing.T) {
+	ctx := context.Background()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := gnatsd.RunServer(&opts)
+	defer func() { s.Shutdown() }()
+
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, testPort),
+		nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	conn, err := connections.NewJetstreamFromConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const subject = "events"
+	subOpts := defaultSubOptions(subject, t.Name())
+	subOpts.ConsumerMaxBatchTimeoutMs = 200
+	ps, err := OpenSubscription(ctx, conn, subOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	topicOpts := &connections.TopicOptions{
+		Subject: subject,
+		Outbox:  &connections.OutboxOptions{Dir: t.TempDir(), RelayInterval: 50 * time.Millisecond},
+	}
+	pt, err := OpenTopic(ctx, conn, topicOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); nc.IsConnected() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bodies := []string{"first", "second", "third"}
+	for _, body := range bodies {
+		if err = pt.Send(ctx, &pubsub.Message{Body: []byte(body)}); err != nil {
+			t.Fatalf("Expected the message to be stored while disconnected, got %v", err)
+		}
+	}
+
+	var itopic connections.Topic
+	if !pt.As(&itopic) {
+		t.Fatal("Expected the topic to expose its connection topic")
+	}
+	if pending := itopic.(*connections.OutboxTopic).Pending(); pending == 0 {
+		t.Fatal("Expected the messages to wait in the outbox")
+	}
+
+	// The stored messages outlive the topic, and are relayed by the next one opened on the same directory.
+	if err = pt.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s = gnatsd.RunServer(&opts)
+
+	pt, err = OpenTopic(ctx, conn, topicOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	receiveCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, body := range bodies {
+		msg, err0 := ps.Receive(receiveCtx)
+		if err0 != nil {
+			t.Fatal(err0)
+		}
+		msg.Ack()
+		if string(msg.Body) != body {
+			t.Fatalf("Expected %q to be relayed in order, got %q", body, msg.Body)
+		}
+	}
+}
+
+func TestOutboxFull(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	pt, err := OpenTopic(ctx, h.conn, &connections.TopicOptions{
+		Subject: "events",
+		Outbox:  &connections.OutboxOptions{Dir: t.TempDir(), MaxBytes: 16},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	h.s.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); h.nc.IsConnected() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("does not fit in sixteen bytes")})
+	if gcerrors.Code(err) != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected the outbox to be full, got %v", err)
+	}
+}
+
+// batchTopic is a connection topic recording what it publishes, failing the batch positions set in fail.
+type batchTopic struct {
+	mutex     sync.Mutex
+	published []*nats.Msg
+	batches   int
+	fail      map[int]error
+}
+
+func (t *batchTopic) Subject() string {
+	return "events"
+}
+
+func (t *batchTopic) PublishMessage(_ context.Context, msg *nats.Msg) (*jetstream.PubAck, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.published = append(t.published, msg)
+	return nil, nil
+}
+
+func (t *batchTopic) PublishMessages(ctx context.Context, msgs []*nats.Msg) ([]*jetstream.PubAck, error) {
+	t.mutex.Lock()
+	t.batches++
+	fail := t.fail
+	t.fail = nil
+	t.mutex.Unlock()
+
+	failed := map[int]error{}
+	for i, msg := range msgs {
+		if err, ok := fail[i]; ok {
+			failed[i] = err
+			continue
+		}
+		_, _ = t.PublishMessage(ctx, msg)
+	}
+	if len(failed) > 0 {
+		return make([]*jetstream.PubAck, len(msgs)), &connections.PublishBatchError{Failed: failed}
+	}
+	return make([]*jetstream.PubAck, len(msgs)), nil
+}
+
+func (t *batchTopic) bodies() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	bodies := make([]string, 0, len(t.published))
+	for _, msg := range t.published {
+		bodies = append(bodies, string(msg.Data))
+	}
+	return bodies
+}
+
+func TestOutboxPublishesBatches(t *testing.T) {
+	ctx := context.Background()
+
+	inner := &batchTopic{fail: map[int]error{
+		1: nats.ErrDisconnected,
+		2: nats.ErrBadSubject,
+	}}
+	outbox, err := connections.NewOutboxTopic(inner, nil, connections.OutboxOptions{Dir: t.TempDir(), RelayInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = outbox.Close() }()
+
+	msgs := []*nats.Msg{
+		{Subject: "events", Data: []byte("first")},
+		{Subject: "events", Data: []byte("second"), Header: nats.Header{"a": {"1"}}},
+		{Subject: "events", Data: []byte("third")},
+	}
+
+	// The batch goes to the wrapped topic as a whole, so its publish options apply to it.
+	_, err = outbox.PublishMessages(ctx, msgs)
+	var batchErr *connections.PublishBatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a batch error, got %v", err)
+	}
+	if len(batchErr.Failed) != 1 || !errors.Is(batchErr.Failed[2], nats.ErrBadSubject) {
+		t.Fatalf("Expected only the invalid message to fail, got %v", batchErr.Failed)
+	}
+	if inner.batches != 1 {
+		t.Fatalf("Expected the batch to be handed over once, got %d", inner.batches)
+	}
+	if outbox.Pending() == 0 {
+		t.Fatal("Expected the unreachable message to be stored")
+	}
+	if _, ok := msgs[1].Header[jetstream.MsgIDHeader]; ok {
+		t.Fatalf("Expected the header of the caller to be left unchanged, got %v", msgs[1].Header)
+	}
+
+	// With a message waiting, later batches are stored behind it.
+	if _, err = outbox.PublishMessages(ctx, []*nats.Msg{{Subject: "events", Data: []byte("fourth")}}); err != nil {
+		t.Fatal(err)
+	}
+	if inner.batches != 1 {
+		t.Fatalf("Expected the batch to be stored, got %d batches handed over", inner.batches)
+	}
+}
+
+func TestOutboxSkipsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	// A record that can not be read back sits in front of a valid one, as left by a damaged disk.
+	valid, err := json.Marshal(map[string]any{"subject": "events", "data": []byte("valid"), "stored": time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := append([]byte("{not json\n"), append(valid, '\n')...)
+	if err = os.WriteFile(filepath.Join(dir, "outbox.wal"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := make(chan error, 10)
+	inner := &batchTopic{}
+	outbox, err := connections.NewOutboxTopic(inner, nil, connections.OutboxOptions{
+		Dir:           dir,
+		RelayInterval: 10 * time.Millisecond,
+		ErrorHandler:  func(err error) { reported <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = outbox.Close() }()
+
+	for deadline := time.Now().Add(5 * time.Second); outbox.Pending() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := inner.bodies(); !slices.Equal(got, []string{"valid"}) {
+		t.Fatalf("Expected the relay to move past the corrupt record, got %v", got)
+	}
+
+	select {
+	case err = <-reported:
+		if !strings.Contains(err.Error(), "corrupt") {
+			t.Fatalf("Expected the corrupt record to be reported, got %v", err)
+		}
+	default:
+		t.Fatal("Expected the corrupt record to be reported")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "outbox.offset.tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the offset to be renamed into place, got %v", err)
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		codec    connections.HeaderCodec
+		metadata map[string]string
+		want     nats.Header
+	}{
+		{"Single", nil, map[string]string{"a": "1"}, nats.Header{"a": {"1"}}},
+		{"Several", nil, map[string]string{"a": "1", "a[1]": "2", "a[2]": "3"}, nats.Header{"a": {"1", "2", "3"}}},
+		{"Gap", nil, map[string]string{"a": "1", "a[2]": "3"}, nats.Header{"a": {"1"}, "a%5B2%5D": {"3"}}},
+		{"NoFirst", nil, map[string]string{"a[1]": "2"}, nats.Header{"a%5B1%5D": {"2"}}},
+		{"Escaped", nil, map[string]string{"a b": "c d", "a b[1]": "e"}, nats.Header{"a+b": {"c+d", "e"}}},
+		{"Raw", connections.RawHeaderCodec{}, map[string]string{"Content-Type": "a+b%20c", "a[1]": "2"},
+			nats.Header{"Content-Type": {"a+b%20c"}, "a[1]": {"2"}}},
+		{"Base64", connections.Base64HeaderCodec{}, map[string]string{"blob": "\x00\xff", "blob[1]": "x"},
+			nats.Header{"blob": {"AP8=", "eA=="}}},
+		{"ServerHeadersUnchanged", connections.Base64HeaderCodec{}, map[string]string{jetstream.MsgIDHeader: "id 1"},
+			nats.Header{jetstream.MsgIDHeader: {"id 1"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := connections.EncodeMetadata(test.metadata, test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Expected %v, got %v", test.want, got)
+			}
+			for k, values := range test.want {
+				if !slices.Equal(got[k], values) {
+					t.Fatalf("Expected %v, got %v", test.want, got)
+				}
+			}
+
+			decoded, err := connections.DecodeHeader(got, test.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(test.metadata) {
+				t.Fatalf("Expected %v to round trip, got %v", test.metadata, decoded)
+			}
+			for k, v := range test.metadata {
+				if decoded[k] != v {
+					t.Fatalf("Expected %v to round trip, got %v", test.metadata, decoded)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeHeaderRejectsCollidingHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		codec  connections.HeaderCodec
+		header nats.Header
+	}{
+		{"ValueIndex", connections.RawHeaderCodec{}, nats.Header{"k": {"1", "2"}, "k[1]": {"3"}}},
+		{"Escaped", nil, nats.Header{"a+b": {"1"}, "a%20b": {"2"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := connections.DecodeHeader(test.header, test.codec); !errors.Is(err, connections.ErrInvalidHeader) {
+				t.Fatalf("Expected %v to be rejected, got %v, %v", test.header, got, err)
+			}
+		})
+	}
+
+	// A header named like a further value is kept when the header it would extend has a single value.
+	got, err := connections.DecodeHeader(nats.Header{"k": {"1"}, "k[1]": {"2"}}, connections.RawHeaderCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["k"] != "1" || got["k[1]"] != "2" {
+		t.Fatalf("Expected both headers to be kept, got %v", got)
+	}
+}
+
+func TestRawHeaderCodecRejectsInvalidHeaders(t *testing.T) {
+	tests := []map[string]string{
+		{"has space": "v"},
+		{"has:colon": "v"},
+		{"": "v"},
+		{"key": "line\r\nbreak"},
+		{"key": " padded"},
+	}
+
+	for _, metadata := range tests {
+		if _, err := connections.EncodeMetadata(metadata, connections.RawHeaderCodec{}); !errors.Is(err, connections.ErrInvalidHeader) {
+			t.Errorf("Expected %v to be rejected, got %v", metadata, err)
+		}
+	}
+}
+
+func TestHeaderCodecInterop(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	const subject = "interop"
+
+	opts := defaultSubOptions(subject, t.Name())
+	opts.HeaderCodec = connections.RawHeaderCodec{}
+	ps, err := OpenSubscription(ctx, h.conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	pt, err := OpenTopic(ctx, h.conn, &connections.TopicOptions{Subject: subject, HeaderCodec: connections.RawHeaderCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	raw, err := h.nc.SubscribeSync(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Unsubscribe()
+
+	// Values a query escaping codec could not decode, as sent by producers in other languages.
+	foreign := nats.NewMsg(subject)
+	foreign.Header.Set("Discount", "100%")
+	foreign.Header.Set("Formula", "a+b")
+	if err = h.nc.PublishMsg(foreign); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ps.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Ack()
+	if msg.Metadata["Discount"] != "100%" || msg.Metadata["Formula"] != "a+b" {
+		t.Fatalf("Expected the headers as sent, got %v", msg.Metadata)
+	}
+	if _, err = raw.NextMsg(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Consumers in other languages see the metadata without any escaping.
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("x"), Metadata: map[string]string{"Order-Id": "a/b c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen, err := raw.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := seen.Header.Get("Order-Id"); got != "a/b c" {
+		t.Fatalf("Expected the header unescaped, got %q", got)
+	}
+
+	err = pt.Send(ctx, &pubsub.Message{Body: []byte("x"), Metadata: map[string]string{"bad key": "v"}})
+	if gcerrors.Code(err) != gcerrors.InvalidArgument {
+		t.Fatalf("Expected an invalid header to be rejected, got %v", err)
+	}
+}
+
+func TestMultiValueHeaders(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		newHarness func(context.Context, *testing.T) (drivertest.Harness, error)
+	}{
+		{"Plain", newPlainHarness},
+		{"Jetstream", newJetstreamHarness},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dh, err := test.newHarness(ctx, t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dh.Close()
+			h := dh.(*harness)
+
+			const subject = "headers"
+
+			ps, err := OpenSubscription(ctx, h.conn, defaultSubOptions(subject, t.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ps.Shutdown(ctx)
+
+			pt, err := OpenTopic(ctx, h.conn, &connections.TopicOptions{Subject: subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pt.Shutdown(ctx)
+
+			// Published the way a producer unaware of this driver would, with several values for one header.
+			raw := nats.NewMsg(subject)
+			raw.Data = []byte("negotiate")
+			raw.Header["Accept"] = []string{"json", "xml", "text"}
+			raw.Header["Trace"] = []string{"abc"}
+			if err = h.nc.PublishMsg(raw); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := ps.Receive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Ack()
+
+			expected := map[string]string{
+				"Accept":    "json",
+				"Accept[1]": "xml",
+				"Accept[2]": "text",
+				"Trace":     "abc",
+			}
+			for k, v := range expected {
+				if got := msg.Metadata[k]; got != v {
+					t.Fatalf("Expected metadata %s to be %q, got %q in %v", k, v, got, msg.Metadata)
+				}
+			}
+
+			var header nats.Header
+			if !msg.As(&header) || !slices.Equal(header["Accept"], raw.Header["Accept"]) {
+				t.Fatalf("Expected the raw headers through As, got %v", header)
+			}
+
+			// Publishing the received metadata again restores the original headers.
+			if err = pt.Send(ctx, &pubsub.Message{Body: msg.Body, Metadata: msg.Metadata}); err != nil {
+				t.Fatal(err)
+			}
+
+			again, err := ps.Receive(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again.Ack()
+
+			if !again.As(&header) {
+				t.Fatal("Expected the raw headers through As")
+			}
+			for k, values := range raw.Header {
+				if !slices.Equal(header[k], values) {
+					t.Fatalf("Expected header %s to round trip as %v, got %v", k, values, header[k])
+				}
+			}
+			if len(header) != len(raw.Header) {
+				t.Fatalf("Expected exactly the original headers, got %v", header)
+			}
+		})
+	}
+}
+
+func TestValidateParameters(t *testing.T) {
+	tests := []struct {
+		Query   url.Values
+		WantErr error
+	}{
+		{url.Values{"subject": {"foo"}, "jetstream": {"true"}}, nil},
+		{url.Values{"Consumer_Max_Count": {"2"}}, nil},
+		{url.Values{"param": {"value"}}, errNotSupportedParameter},
+		{url.Values{"subject": {"foo", "bar"}}, errDuplicateParameter},
+	}
+
+	for _, test := range tests {
+		if err := validateParameters(test.Query); !errors.Is(err, test.WantErr) {
+			t.Errorf("%v: got error %v, want %v", test.Query, err, test.WantErr)
+		}
+	}
+}
+
+func TestURLParametersValidatedForCachedConnections(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+
+	// The first URL dials and caches the connection, the second one reuses it and must still be validated.
+	topic, err := pubsub.OpenTopic(ctx, "nats://127.0.0.1:11222/cached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Shutdown(ctx)
+
+	// The url mux does not wrap the error of the opener, so only its text can be compared.
+	_, err = pubsub.OpenTopic(ctx, "nats://127.0.0.1:11222/cached?param=value")
+	if err == nil || !strings.Contains(err.Error(), errNotSupportedParameter.Error()) {
+		t.Fatalf("got error %v, want %v", err, errNotSupportedParameter)
+	}
+}
+
+func TestOpenTopicURLSetsSubject(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+
+	opener := &URLOpener{Connection: dh.(*harness).conn}
+	u, err := url.Parse("nats://127.0.0.1:11222/orders?subject=shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := opener.OpenTopicURL(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pt.Shutdown(ctx)
+
+	var tp connections.Topic
+	if !pt.As(&tp) {
+		t.Fatal("cast failed for connections.Topic")
+	}
+	if got := tp.Subject(); got != "shop/orders" {
+		t.Errorf("got subject %q, want %q", got, "shop/orders")
+	}
+	if opener.TopicOptions.Subject != "" {
+		t.Errorf("opening a topic changed the subject of the opener to %q", opener.TopicOptions.Subject)
+	}
+}
+
+func TestOpenSubscriptionURLJoinsPathToEverySubject(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newPlainHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	opener := &URLOpener{Connection: h.conn}
+	u, err := url.Parse("nats://127.0.0.1:11222/orders?subject=shop,store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err := opener.OpenSubscriptionURL(ctx, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown(ctx)
+
+	for _, subject := range []string{"shop/orders", "store/orders"} {
+		if err = h.nc.Publish(subject, []byte(subject)); err != nil {
+			t.Fatal(err)
+		}
+
+		receiveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msg, err := ps.Receive(receiveCtx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", subject, err)
+		}
+		msg.Ack()
+		if string(msg.Body) != subject {
+			t.Errorf("got %q, want a message published to %q", msg.Body, subject)
+		}
+	}
+}
+
+func TestJetstreamSubscriptionStreamLookup(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	// A missing stream is created.
+	opts := defaultSubOptions("lookup", t.Name())
+	queue, err := h.conn.CreateSubscription(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Unsubscribe()
+
+	js, err := jetstream.New(h.nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = js.Stream(ctx, opts.SetupOpts.StreamName); err != nil {
+		t.Fatalf("stream %s was not created : %v", opts.SetupOpts.StreamName, err)
+	}
+
+	// An existing stream is reused.
+	opts = defaultSubOptions("lookup", t.Name())
+	opts.SetupOpts.DurableQueue = "second"
+	second, err := h.conn.CreateSubscription(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Unsubscribe()
+
+	// Any other lookup failure is returned rather than creating a stream.
+	opts = defaultSubOptions("lookup", t.Name())
+	opts.SetupOpts.StreamName = "invalid.stream"
+	if _, err = h.conn.CreateSubscription(ctx, opts); !errors.Is(err, jetstream.ErrInvalidStreamName) {
+		t.Fatalf("got error %v, want %v", err, jetstream.ErrInvalidStreamName)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	ctx := context.Background()
+	dh, err := newJetstreamHarness(ctx, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dh.Close()
+	h := dh.(*harness)
+
+	// Topics
+	dt, err := openTopic(ctx, h.conn, &connections.TopicOptions{Subject: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gce := dt.ErrorCode(nil); gce != gcerrors.OK {
+		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
+	}
+	if gce := dt.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
+		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+	}
+	if gce := dt.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
+		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	}
+	if gce := dt.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
+		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+	}
+	if gce := dt.ErrorCode(nats.ErrMaxPayload); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+	if gce := dt.ErrorCode(nats.ErrReconnectBufExceeded); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+
+	// Subscriptions
+	opts := defaultSubOptions("bar", t.Name())
+
+	ds, err := openSubscription(ctx, h.conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gce := ds.ErrorCode(nil); gce != gcerrors.OK {
+		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
+	}
+	if gce := ds.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
+		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
+		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrBadSubscription); gce != gcerrors.NotFound {
+		t.Fatalf("Expected %v, got %v", gcerrors.NotFound, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrTypeSubscription); gce != gcerrors.FailedPrecondition {
+		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
+		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrMaxMessages); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrSlowConsumer); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+	if gce := ds.ErrorCode(nats.ErrTimeout); gce != gcerrors.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", gcerrors.DeadlineExceeded, gce)
+	}
+
+	// Queue Subscription
+	opts = defaultSubOptions("bar", t.Name())
+
+	qs, err := openSubscription(ctx, h.conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gce := qs.ErrorCode(nil); gce != gcerrors.OK {
+		t.Fatalf("Expected %v, got %v", gcerrors.OK, gce)
+	}
+	if gce := qs.ErrorCode(context.Canceled); gce != gcerrors.Canceled {
+		t.Fatalf("Expected %v, got %v", gcerrors.Canceled, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrBadSubject); gce != gcerrors.FailedPrecondition {
+		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrBadSubscription); gce != gcerrors.NotFound {
+		t.Fatalf("Expected %v, got %v", gcerrors.NotFound, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrTypeSubscription); gce != gcerrors.FailedPrecondition {
+		t.Fatalf("Expected %v, got %v", gcerrors.FailedPrecondition, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrAuthorization); gce != gcerrors.PermissionDenied {
+		t.Fatalf("Expected %v, got %v", gcerrors.PermissionDenied, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrMaxMessages); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrSlowConsumer); gce != gcerrors.ResourceExhausted {
+		t.Fatalf("Expected %v, got %v", gcerrors.ResourceExhausted, gce)
+	}
+	if gce := qs.ErrorCode(nats.ErrTimeout); gce != gcerrors.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", gcerrors.DeadlineExceeded, gce)
+	}
+}
+
+func BenchmarkNatsQueuePubSub(b *testing.B) {
+	ctx := context.Background()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = benchPort
+	s := gnatsd.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, benchPort))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	conn := connections.NewJetstream(js)
+
+	h := &harness{s: s, conn: conn}
+
+	b.Run("Jetstream", func(b *testing.B) {
+		dt, cleanup, err := h.CreateTopic(ctx, b.Name())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cleanup()
+
+		qs, cleanup, err := h.CreateQueueSubscription(ctx, dt, b.Name())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cleanup()
+
+		topic := pubsub.NewTopic(dt, nil)
+		defer topic.Shutdown(ctx)
+
+		queueSub := pubsub.NewSubscription(qs, &batcher.Options{
+			MaxBatchSize: 100,
+			MaxHandlers:  10, // max concurrency for receives
+		}, nil)
+		defer queueSub.Shutdown(ctx)
 
 		drivertest.RunBenchmarks(b, topic, queueSub)
 	})
@@ -671,6 +3956,10 @@ func TestOpenTopicFromURL(t *testing.T) {
 		{"nats://localhost:11222/mytopic", false},
 		// Invalid parameter.
 		{"nats://localhost:11222/mytopic?param=value", true},
+		// Header codec.
+		{"nats://localhost:11222/mytopic?header_codec=base64", false},
+		// Unknown header codec.
+		{"nats://localhost:11222/mytopic?header_codec=rot13", true},
 	}
 
 	for _, test := range tests {
@@ -702,6 +3991,20 @@ func TestOpenSubscriptionFromURL(t *testing.T) {
 		{"nats://localhost:11222/mytopic?param=value", true},
 		// Queue URL Parameter for QueueSubscription.
 		{"nats://localhost:11222/mytopic?queue=queue1", false},
+		// Consumer redelivery backoff.
+		{"nats://localhost:11222/mytopic?consumer_max_deliver=5&consumer_backoff=1s,5s", false},
+		// Invalid consumer redelivery backoff.
+		{"nats://localhost:11222/mytopic?consumer_backoff=soon", true},
+		// Dead letter subject.
+		{"nats://localhost:11222/mytopic?consumer_max_deliver=5&dlq_subject=mytopic_dead", false},
+		// Acknowledged delivery over plain nats.
+		{"nats://localhost:11222/mytopic?acknowledged=true", false},
+		// Invalid acknowledged flag.
+		{"nats://localhost:11222/mytopic?acknowledged=maybe", true},
+		// Raw header codec.
+		{"nats://localhost:11222/mytopic?header_codec=raw", false},
+		// Unknown header codec.
+		{"nats://localhost:11222/mytopic?header_codec=rot13", true},
 		// Multiple values for Queue URL Parameter for QueueSubscription.
 		{"nats://localhost:11222/mytopic?subject=queue1&subject=queue2", true},
 	}
@@ -716,3 +4019,77 @@ func TestOpenSubscriptionFromURL(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkJetstreamPublish(b *testing.B) {
+	ctx := context.Background()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = benchPort
+	opts.JetStream = true
+	opts.StoreDir = b.TempDir()
+	s := gnatsd.RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf(testServerUrlFmt, benchPort))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	conn := connections.NewJetstream(js)
+
+	const senders = 100
+
+	for _, bench := range []struct {
+		name       string
+		maxPending int
+	}{
+		{"Sync", 0},
+		{"Async", 256},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			subject := sanitizeName(b.Name())
+			_, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: subject, Subjects: []string{subject}})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			topic, err := OpenTopic(ctx, conn, &connections.TopicOptions{Subject: subject, MaxPendingPublishes: bench.maxPending})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer topic.Shutdown(ctx)
+
+			body := []byte("benchmark")
+			work := make(chan struct{})
+			errs := make(chan error, senders)
+			for i := 0; i < senders; i++ {
+				go func() {
+					var err error
+					for range work {
+						if err == nil {
+							err = topic.Send(ctx, &pubsub.Message{Body: body})
+						}
+					}
+					errs <- err
+				}()
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				work <- struct{}{}
+			}
+			close(work)
+			for i := 0; i < senders; i++ {
+				if err = <-errs; err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}